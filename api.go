@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1_000
+)
+
+// objectPage is a page of stored object statuses, NextCursor is empty on the last page
+type objectPage struct {
+	Objects    []ObjectDetail `json:"objects"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// objectQuery filters the stored object statuses
+type objectQuery struct {
+	online *bool
+	since  time.Time
+	//attrs are the values of mapped fields, keyed by column
+	attrs map[string]interface{}
+	after int
+	limit int
+}
+
+const objectColumns = "id, online, lastseen, unknown, attributes"
+
+// scanObject reads a row of objectColumns
+func scanObject(row interface{ Scan(...interface{}) error }) (ObjectDetail, error) {
+	var (
+		detail     ObjectDetail
+		attributes []byte
+	)
+	if err := row.Scan(&detail.ID, &detail.Online, &detail.LastSeen, &detail.Unknown, &attributes); err != nil {
+		return ObjectDetail{}, err
+	}
+	if err := json.Unmarshal(attributes, &detail.Attributes); err != nil {
+		return ObjectDetail{}, fmt.Errorf("error decoding attributes of object %d: %v", detail.ID, err)
+	}
+	if len(detail.Attributes) == 0 {
+		detail.Attributes = nil
+	}
+	return detail, nil
+}
+
+// getObject reads the stored status of a single object
+func (db *database) getObject(ctx context.Context, id int) (ObjectDetail, error) {
+	query := "select " + objectColumns + " from object_state where id = $1"
+
+	return scanObject(db.db.QueryRowContext(ctx, query, id))
+}
+
+// listObjects reads stored statuses ordered by id, starting after q.after
+func (db *database) listObjects(ctx context.Context, q objectQuery) ([]ObjectDetail, error) {
+	conds := []string{"id > $1"}
+	args := []interface{}{q.after}
+
+	if q.online != nil {
+		args = append(args, *q.online)
+		conds = append(conds, fmt.Sprintf("online = $%d", len(args)))
+	}
+	if !q.since.IsZero() {
+		args = append(args, q.since)
+		conds = append(conds, fmt.Sprintf("lastseen >= $%d", len(args)))
+	}
+	for _, f := range db.fields {
+		if value, ok := q.attrs[f.column()]; ok {
+			args = append(args, value)
+			conds = append(conds, fmt.Sprintf("%s = $%d", f.column(), len(args)))
+		}
+	}
+	args = append(args, q.limit)
+
+	query := fmt.Sprintf("select "+objectColumns+" from object_state where %s order by id limit $%d",
+		strings.Join(conds, " and "), len(args))
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	details := make([]ObjectDetail, 0, q.limit)
+	for rows.Next() {
+		detail, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		details = append(details, detail)
+	}
+	return details, rows.Err()
+}
+
+// handleObject serves GET /objects/{id} and GET /objects/{id}/transitions
+func (db *database) handleObject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, sub, err := parseObjectPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	switch sub {
+	case "":
+	case "transitions":
+		db.handleTransitions(w, r, id)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	detail, err := db.getObject(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logFor(r.Context()).error("error reading object", "object_id", id, "error", err)
+		http.Error(w, "error reading object", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// handleObjects serves GET /objects?online=true&since=RFC3339&limit=N&cursor=C,
+// also filtering on mapped fields given by name, such as region=eu
+func (db *database) handleObjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := parseObjectQuery(r, db.fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	details, err := db.listObjects(r.Context(), q)
+	if err != nil {
+		logFor(r.Context()).error("error listing objects", "error", err)
+		http.Error(w, "error listing objects", http.StatusInternalServerError)
+		return
+	}
+
+	page := objectPage{Objects: details}
+	if len(details) == q.limit {
+		page.NextCursor = strconv.Itoa(details[len(details)-1].ID)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+func parseObjectQuery(r *http.Request, fields []fieldMapping) (objectQuery, error) {
+	values := r.URL.Query()
+	q := objectQuery{after: math.MinInt32, limit: defaultPageSize, attrs: make(map[string]interface{})}
+
+	if raw := values.Get("online"); raw != "" {
+		online, err := strconv.ParseBool(raw)
+		if err != nil {
+			return q, fmt.Errorf("invalid online %q", raw)
+		}
+		q.online = &online
+	}
+	if raw := values.Get("since"); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return q, fmt.Errorf("invalid since %q, expected RFC3339", raw)
+		}
+		q.since = since
+	}
+	for _, f := range fields {
+		if raw := values.Get(f.Name); raw != "" {
+			value, err := f.parse(raw)
+			if err != nil {
+				return q, err
+			}
+			q.attrs[f.column()] = value
+		}
+	}
+	limit, err := parseLimit(values.Get("limit"))
+	if err != nil {
+		return q, err
+	}
+	q.limit = limit
+
+	if raw := values.Get("cursor"); raw != "" {
+		//ids are psql integers, a larger cursor would fail the query instead of the request
+		after, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor %q", raw)
+		}
+		q.after = int(after)
+	}
+	return q, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logs.error("error encoding response", "error", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstream auth kinds
+const (
+	authNone   = ""
+	authBearer = "bearer"
+	authBasic  = "basic"
+	authOAuth2 = "oauth2"
+)
+
+// tokenExpirySkew is how long before its expiry an oauth2 token is refreshed
+const tokenExpirySkew = 30 * time.Second
+
+// tokenMaxLifetime is how long an oauth2 token sent without expires_in is used before it's refreshed
+const tokenMaxLifetime = time.Hour
+
+// authorizer adds credentials to upstream requests
+type authorizer interface {
+	authorize(ctx context.Context, req *http.Request) error
+}
+
+// authError is returned when no credentials could be gotten for an upstream request. The failure
+// of the token endpoint is only kept as text, so its statuses aren't taken for the ones of the objects api
+type authError struct {
+	msg string
+	//temporary failures, such as network errors or 5xx from the token endpoint, are worth retrying
+	temporary bool
+}
+
+func (e *authError) Error() string {
+	return "error fetching oauth2 token: " + e.msg
+}
+
+func newAuthError(err error) *authError {
+	var status *statusError
+	if errors.As(err, &status) {
+		return &authError{
+			msg:       fmt.Sprintf("token endpoint responded %d %s", status.code, http.StatusText(status.code)),
+			temporary: retryable(status),
+		}
+	}
+	return &authError{msg: err.Error(), temporary: retryable(err)}
+}
+
+// invalidator is an authorizer whose credentials can go stale, such as revoked or rotated oauth2 tokens
+type invalidator interface {
+	// invalidate drops the credentials req was authorized with, so the next request gets new ones
+	invalidate(req *http.Request)
+}
+
+// newAuthorizer returns the authorizer for cfg, nil when requests aren't authenticated
+func newAuthorizer(cfg authConfig, timeout time.Duration) authorizer {
+	switch cfg.Kind {
+	case authBearer:
+		return bearerAuth(cfg.Token)
+	case authBasic:
+		return basicAuth{user: cfg.Username, password: cfg.Password}
+	case authOAuth2:
+		return &oauth2Source{
+			cli:          &http.Client{Timeout: timeout},
+			tokenURL:     cfg.TokenURL,
+			clientID:     cfg.ClientID,
+			clientSecret: cfg.ClientSecret,
+			scopes:       cfg.Scopes,
+		}
+	}
+	return nil
+}
+
+// bearerAuth sends a static bearer token
+type bearerAuth string
+
+func (a bearerAuth) authorize(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(a))
+	return nil
+}
+
+// basicAuth sends a username and password
+type basicAuth struct {
+	user, password string
+}
+
+func (a basicAuth) authorize(ctx context.Context, req *http.Request) error {
+	req.SetBasicAuth(a.user, a.password)
+	return nil
+}
+
+// oauth2Source sends a bearer token gotten with the oauth2 client credentials grant,
+// cached until shortly before it expires, for at most tokenMaxLifetime without an expiry, or until upstream rejects it
+type oauth2Source struct {
+	cli          *http.Client
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (s *oauth2Source) authorize(ctx context.Context, req *http.Request) error {
+	token, err := s.current(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// current returns the cached token, fetching a new one when it's missing or about to expire
+func (s *oauth2Source) current(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiry) > tokenExpirySkew {
+		return s.token, nil
+	}
+
+	token, expiresIn, err := s.fetch(ctx)
+	if err != nil {
+		return "", newAuthError(err)
+	}
+	if expiresIn <= 0 {
+		expiresIn = tokenMaxLifetime
+	}
+	s.token = token
+	s.expiry = time.Now().Add(expiresIn)
+	logFor(ctx).debug("fetched oauth2 token", "token_url", s.tokenURL, "expires_in", expiresIn)
+
+	return s.token, nil
+}
+
+// invalidate drops the cached token if req was sent with it, a newer one fetched meanwhile is kept
+func (s *oauth2Source) invalidate(req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && req.Header.Get("Authorization") == "Bearer "+s.token {
+		s.token = ""
+	}
+}
+
+func (s *oauth2Source) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(s.clientSecret))
+
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", 0, &statusError{
+			code:       resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	body := struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", 0, err
+	}
+	if body.AccessToken == "" {
+		return "", 0, fmt.Errorf("no access_token in response")
+	}
+	if body.TokenType != "" && !strings.EqualFold(body.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token_type %q", body.TokenType)
+	}
+
+	return body.AccessToken, time.Duration(body.ExpiresIn) * time.Second, nil
+}
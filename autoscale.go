@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// bounds are the least and most goroutines a group is scaled to
+type bounds struct {
+	min, max int
+}
+
+func (b bounds) clamp(n int) int {
+	if n < b.min {
+		return b.min
+	}
+	if n > b.max {
+		return b.max
+	}
+	return n
+}
+
+// load is what a group is scaled on: its backlog and the latency of the work it does
+type load struct {
+	backlog int
+	sum     float64
+	count   uint64
+}
+
+// autoscaler sizes the worker and writer groups of a pipeline every interval, growing a group
+// while its backlog keeps up or its latency is above target, and shrinking it once idle
+type autoscaler struct {
+	p             *pipeline
+	interval      time.Duration
+	latencyTarget time.Duration
+
+	mu      sync.Mutex
+	workers bounds
+	writers bounds
+	stopped bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newAutoscaler(p *pipeline, cfg config) *autoscaler {
+	a := &autoscaler{
+		p:             p,
+		interval:      time.Duration(cfg.Pool.Interval),
+		latencyTarget: time.Duration(cfg.Pool.LatencyTarget),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	a.setBounds(cfg)
+	return a
+}
+
+// setBounds changes the bounds of both groups, resizing them right away when out of bounds
+func (a *autoscaler) setBounds(cfg config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.workers = bounds{min: cfg.Pool.MinWorkers, max: cfg.Workers}
+	a.writers = bounds{min: cfg.Pool.MinWriters, max: cfg.Writers}
+	if a.stopped {
+		return
+	}
+	a.p.resize(a.workers.clamp(a.p.workers.size()), a.writers.clamp(a.p.writers.size()))
+}
+
+// run scales the groups until stopped
+func (a *autoscaler) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	var lastFetch, lastStore load
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+
+		fetch := load{backlog: a.p.queue.depth()}
+		fetch.sum, fetch.count = fetchDuration.totals()
+		store := load{backlog: len(a.p.result)}
+		store.sum, store.count = storeDuration.totals()
+
+		a.mu.Lock()
+		if !a.stopped {
+			workers := a.next(a.p.workers.size(), a.workers, lastFetch, fetch)
+			writers := a.next(a.p.writers.size(), a.writers, lastStore, store)
+			a.p.resize(workers, writers)
+		}
+		a.mu.Unlock()
+
+		lastFetch, lastStore = fetch, store
+	}
+}
+
+// next returns the size of a group given its load at the previous and current tick.
+// It grows by half while there's a backlog that isn't going down or the work done since
+// the previous tick was slower than the latency target, and shrinks by a quarter once idle
+func (a *autoscaler) next(size int, b bounds, last, now load) int {
+	slow := false
+	if n := now.count - last.count; n > 0 {
+		slow = (now.sum-last.sum)/float64(n) > a.latencyTarget.Seconds()
+	}
+
+	switch {
+	case now.backlog > 0 && (now.backlog >= last.backlog || slow):
+		size += size/2 + 1
+	case now.backlog == 0 && last.backlog == 0:
+		size -= size/4 + 1
+	}
+	return b.clamp(size)
+}
+
+// shutdown stops scaling, leaving the groups at their current size
+func (a *autoscaler) shutdown() {
+	a.mu.Lock()
+	a.stopped = true
+	a.mu.Unlock()
+
+	close(a.stop)
+	<-a.done
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// flush stores a batch of details and records the outcome in the store metrics
+func (db *database) flush(ctx context.Context, batch []ObjectDetail) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := db.toStore(ctx, batch)
+	storeDuration.observe(time.Since(start).Seconds())
+
+	if err != nil {
+		storeBatches.inc("error")
+		storeRows.add(float64(len(batch)), "error")
+		return err
+	}
+
+	storeBatches.inc("ok")
+	storeRows.add(float64(len(batch)), "ok")
+	return nil
+}
+
+// appendHistory appends details routed to history to the objects table, without updating their state
+func (db *database) appendHistory(ctx context.Context, details []ObjectDetail) error {
+	if len(details) == 0 {
+		return nil
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := copyHistory(ctx, tx, details); err != nil {
+		return fmt.Errorf("error copying object history: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing object history: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batchUnsupported reports whether a batch lookup failed because the upstream doesn't
+// have one, in which case ids are fetched one by one from then on
+func batchUnsupported(err error) bool {
+	var status *statusError
+	if !errors.As(err, &status) {
+		return false
+	}
+	switch status.code {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// batching reports whether ids are fetched in batches
+func (c *client) batching() bool {
+	return c.batchPath != "" && atomic.LoadInt32(&c.batchOff) == 0
+}
+
+// fetchBatch posts the object ids to the batch url, {"object_ids": [...]},
+// and returns the details listed in the response
+func (c *client) fetchBatch(ctx context.Context, objectIDs []int) ([]ObjectDetail, error) {
+	cli, _ := c.upstream()
+
+	list := newObjectList()
+	list.ObjectIDs = append(list.ObjectIDs, objectIDs...)
+	body, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.batchPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", c.decoder.accept())
+
+	resp, err := c.do(ctx, cli, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return c.decodeDetails(resp.Body, objectIDs)
+}
+
+// batchWorker is worker for upstreams with a batch lookup: it takes up to c.batchSize
+// jobs already queued at once, fetches them in one request and sends each outcome to result.
+// Once batching is off it takes jobs one at a time like worker, and ids missing from a response
+// are fetched on their own concurrently
+func (c *client) batchWorker(ctx context.Context, stop <-chan struct{}, jobs <-chan job, result chan<- outcome) {
+	pending := make([]job, 0, c.batchSize)
+	for {
+		if !c.batching() {
+			c.worker(ctx, stop, jobs, result)
+			return
+		}
+
+		pending = pending[:0]
+		select {
+		case <-stop:
+			return
+		case next, ok := <-jobs:
+			if !ok {
+				return
+			}
+			pending = append(pending, next)
+		}
+
+	collect:
+		for len(pending) < c.batchSize {
+			select {
+			case next, ok := <-jobs:
+				if !ok {
+					break collect
+				}
+				pending = append(pending, next)
+			default:
+				break collect
+			}
+		}
+
+		//past the shutdown grace period, drain what's left without fetching
+		if ctx.Err() != nil {
+			jobsDropped.add(float64(len(pending)))
+			continue
+		}
+
+		//skip ids whose last result is still fresh
+		claimed := pending[:0]
+		for _, j := range pending {
+			if !c.seen.claim(j.objectID) {
+				idsDeduped.inc()
+				result <- outcome{job: j}
+				continue
+			}
+			claimed = append(claimed, j)
+		}
+
+		c.fetchJobs(ctx, claimed, result)
+	}
+}
+
+// fetchJobs fetches the details of claimed jobs in one batch and sends their outcomes to result
+func (c *client) fetchJobs(ctx context.Context, jobs []job, result chan<- outcome) {
+	if len(jobs) == 0 {
+		return
+	}
+	if !c.batching() || len(jobs) == 1 {
+		c.fetchEach(ctx, jobs, result)
+		return
+	}
+
+	objectIDs := make([]int, len(jobs))
+	for i, j := range jobs {
+		objectIDs[i] = j.objectID
+	}
+
+	//a batch is logged under the correlation id of its first job
+	batchCtx := withCorrelationID(ctx, jobs[0].correlationID)
+	var details []ObjectDetail
+	attempts, err := c.withRetry(batchCtx, func() error {
+		var err error
+		details, err = c.fetchBatch(batchCtx, objectIDs)
+		return err
+	})
+	if batchUnsupported(err) {
+		if atomic.CompareAndSwapInt32(&c.batchOff, 0, 1) {
+			logs.warn("upstream has no batch lookup, fetching ids one by one", "url", c.batchPath, "error", err)
+		}
+		c.fetchEach(ctx, jobs, result)
+		return
+	}
+	if err != nil {
+		for _, j := range jobs {
+			c.fetchFailed(ctx, j, attempts, err, result)
+		}
+		return
+	}
+
+	byID := make(map[int]ObjectDetail, len(details))
+	for _, detail := range details {
+		byID[detail.ID] = detail
+	}
+
+	now := time.Now().UTC()
+	missing := make([]job, 0)
+	for _, j := range jobs {
+		detail, ok := byID[j.objectID]
+		if !ok {
+			missing = append(missing, j)
+			continue
+		}
+		detail.LastSeen = now
+		result <- outcome{job: j, detail: detail, fetched: true}
+	}
+	c.fetchEach(ctx, missing, result)
+}
+
+// fetchEach fetches claimed jobs one by one concurrently, bounded by the concurrency limiter,
+// and returns once all their outcomes are sent to result
+func (c *client) fetchEach(ctx context.Context, jobs []job, result chan<- outcome) {
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			c.fetchJob(ctx, j, result)
+		}(j)
+	}
+	wg.Wait()
+}
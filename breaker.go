@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errBreakerOpen = errors.New("circuit breaker open, upstream unavailable")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breaker is a circuit breaker around the upstream objects api. It opens after threshold
+// consecutive failures, fails fast for cooldown, then lets up to probes requests through
+// half-open, closing again once that many succeed in a row
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	probes    int
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	successes int
+	inflight  int
+	openedAt  time.Time
+	//round counts the half-open states, telling the probes of the current one from late ones
+	round int
+}
+
+func newBreaker(threshold int, cooldown time.Duration, probes int) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		probes:    probes,
+	}
+}
+
+// allow returns errBreakerOpen if a request must not be sent upstream right now,
+// otherwise the caller must report the outcome with done, passing on the half-open round it
+// was let through as a probe of, 0 when it's not a probe
+func (b *breaker) allow() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.cooldown {
+			return 0, errBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.inflight >= b.probes {
+			return 0, errBreakerOpen
+		}
+		b.inflight++
+		return b.round, nil
+	}
+	return 0, nil
+}
+
+// done records the outcome of a request let through by allow,
+// only errors that say something about upstream health count as failures
+func (b *breaker) done(probe int, err error) {
+	failed := err != nil && retryable(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	//only the probes of the current half-open state decide it, requests let through before the breaker
+	//opened, or probes of an earlier half-open state, finishing late tell nothing about upstream now
+	if b.state == breakerHalfOpen && probe != b.round || b.state != breakerHalfOpen && probe != 0 {
+		return
+	}
+
+	//a request the caller gave up on is neither a success nor a failure
+	if canceled(err) {
+		if b.state == breakerHalfOpen {
+			b.inflight--
+		}
+		return
+	}
+
+	switch b.state {
+	case breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.setState(breakerOpen)
+		}
+	case breakerHalfOpen:
+		b.inflight--
+		if failed {
+			b.setState(breakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.probes {
+			b.setState(breakerClosed)
+		}
+	}
+}
+
+// current returns the breaker state
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// setState must be called with b.mu held
+func (b *breaker) setState(state breakerState) {
+	logs.warn("upstream circuit breaker changed state", "from", b.state, "to", state)
+
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	b.inflight = 0
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+	if state == breakerHalfOpen {
+		b.round++
+	}
+}
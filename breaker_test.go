@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errUpstreamDown = &statusError{code: 503}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := newBreaker(3, time.Hour, 1)
+
+	for i := 0; i < 2; i++ {
+		probe, err := b.allow()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		b.done(probe, errUpstreamDown)
+	}
+
+	//a success resets the count, permanent errors don't count
+	probe, _ := b.allow()
+	b.done(probe, nil)
+	for i := 0; i < 5; i++ {
+		probe, _ := b.allow()
+		b.done(probe, &statusError{code: 400})
+	}
+	if got := b.current(); got != breakerClosed {
+		t.Fatalf("state %s, want closed", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		probe, _ := b.allow()
+		b.done(probe, errUpstreamDown)
+	}
+	if got := b.current(); got != breakerOpen {
+		t.Fatalf("state %s after 3 failures, want open", got)
+	}
+	if _, err := b.allow(); err != errBreakerOpen {
+		t.Errorf("allow while open: %v, want errBreakerOpen", err)
+	}
+}
+
+// openBreaker returns a breaker opened by failures, whose cooldown is over
+func openBreaker(t *testing.T, probes int) *breaker {
+	b := newBreaker(1, 10*time.Millisecond, probes)
+	probe, _ := b.allow()
+	b.done(probe, errUpstreamDown)
+	if got := b.current(); got != breakerOpen {
+		t.Fatalf("state %s, want open", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	return b
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []error
+		want     breakerState
+	}{
+		{"probes succeed", []error{nil, nil}, breakerClosed},
+		{"a probe fails", []error{nil, errUpstreamDown}, breakerOpen},
+		{"a probe gets a permanent error", []error{nil, errors.New("bad request")}, breakerClosed},
+	}
+
+	for _, tt := range tests {
+		b := openBreaker(t, 2)
+		if got := b.current(); got != breakerHalfOpen {
+			t.Fatalf("%s: state %s after cooldown, want half-open", tt.name, got)
+		}
+
+		//only probes requests are let through at a time
+		probes := make([]int, 2)
+		for i := range probes {
+			var err error
+			if probes[i], err = b.allow(); err != nil {
+				t.Fatalf("%s: probe %d: %v", tt.name, i, err)
+			}
+		}
+		if _, err := b.allow(); err != errBreakerOpen {
+			t.Errorf("%s: allow beyond probes: %v, want errBreakerOpen", tt.name, err)
+		}
+
+		for i, err := range tt.outcomes {
+			b.done(probes[i], err)
+		}
+		if got := b.current(); got != tt.want {
+			t.Errorf("%s: state %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBreakerCanceledProbe(t *testing.T) {
+	b := openBreaker(t, 1)
+
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.done(probe, context.Canceled)
+
+	//the canceled probe frees its slot without deciding anything
+	if got := b.current(); got != breakerHalfOpen {
+		t.Fatalf("state %s, want half-open", got)
+	}
+	probe, err = b.allow()
+	if err != nil {
+		t.Fatalf("allow after a canceled probe: %v", err)
+	}
+	b.done(probe, nil)
+	if got := b.current(); got != breakerClosed {
+		t.Errorf("state %s, want closed", got)
+	}
+}
+
+func TestBreakerLateOutcomes(t *testing.T) {
+	b := newBreaker(1, 10*time.Millisecond, 1)
+
+	//let through while closed, finishing once the breaker is half-open
+	late, _ := b.allow()
+	probe, _ := b.allow()
+	b.done(probe, errUpstreamDown)
+	time.Sleep(20 * time.Millisecond)
+
+	first, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.done(late, nil)
+	b.done(late, errUpstreamDown)
+	if b.inflight != 1 || b.current() != breakerHalfOpen {
+		t.Fatalf("late outcomes changed the half-open state: inflight %d, state %s", b.inflight, b.current())
+	}
+
+	//a probe of an earlier half-open state finishing late doesn't count either
+	b.done(first, errUpstreamDown)
+	time.Sleep(20 * time.Millisecond)
+	second, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.done(first, nil)
+	if b.inflight != 1 || b.current() != breakerHalfOpen {
+		t.Fatalf("late probe changed the half-open state: inflight %d, state %s", b.inflight, b.current())
+	}
+
+	b.done(second, nil)
+	if b.inflight < 0 || b.current() != breakerClosed {
+		t.Errorf("inflight %d, state %s, want closed", b.inflight, b.current())
+	}
+}
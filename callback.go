@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// callbackResult is the body of every /callback response
+type callbackResult struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+// ingester enqueues the object ids received on /callback without blocking the caller
+// for longer than timeout, rejecting whatever doesn't fit in the queue by then
+type ingester struct {
+	queue      jobQueue
+	timeout    time.Duration
+	retryAfter time.Duration
+	breaker    *breaker
+}
+
+func newIngester(queue jobQueue, timeout, retryAfter time.Duration, breaker *breaker) *ingester {
+	return &ingester{
+		queue:      queue,
+		timeout:    timeout,
+		retryAfter: retryAfter,
+		breaker:    breaker,
+	}
+}
+
+// handleCallback responds 202 once every id is queued, 429 when the queue filled up
+// before the deadline and 503 while upstream or the queue is unavailable, both with Retry-After
+func (in *ingester) handleCallback(w http.ResponseWriter, r *http.Request) {
+	cid := r.Header.Get("X-Correlation-ID")
+	if cid == "" {
+		cid = newCorrelationID()
+	}
+	w.Header().Set("X-Correlation-ID", cid)
+	ctx := withCorrelationID(r.Context(), cid)
+	log := logFor(ctx)
+
+	if r.Body == nil {
+		log.warn("nil request body")
+		callbacksReceived.inc(strconv.Itoa(http.StatusBadRequest))
+		http.Error(w, "no request body found", http.StatusBadRequest)
+		return
+	}
+
+	objList := newObjectList()
+	if err := json.NewDecoder(r.Body).Decode(objList); err != nil {
+		log.warn("error decoding request", "error", err)
+		callbacksReceived.inc(strconv.Itoa(http.StatusBadRequest))
+		http.Error(w, "error decoding request", http.StatusBadRequest)
+		return
+	}
+
+	if in.breaker.current() == breakerOpen {
+		in.respond(log, w, http.StatusServiceUnavailable, callbackResult{Rejected: len(objList.ObjectIDs)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, in.timeout)
+	defer cancel()
+
+	accepted, err := in.queue.push(ctx, objList.ObjectIDs)
+	res := callbackResult{Accepted: accepted, Rejected: len(objList.ObjectIDs) - accepted}
+	if err != nil {
+		log.error("error queueing callback", "error", err)
+		in.respond(log, w, http.StatusServiceUnavailable, res)
+		return
+	}
+
+	code := http.StatusAccepted
+	if res.Rejected > 0 {
+		code = http.StatusTooManyRequests
+	}
+	in.respond(log, w, code, res)
+}
+
+func (in *ingester) respond(log *logger, w http.ResponseWriter, code int, res callbackResult) {
+	callbacksReceived.inc(strconv.Itoa(code))
+	idsEnqueued.add(float64(res.Accepted))
+	idsRejected.add(float64(res.Rejected))
+
+	log.info("callback received", "code", code, "accepted", res.Accepted, "rejected", res.Rejected)
+	if res.Rejected > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((in.retryAfter+time.Second-1)/time.Second)))
+	}
+	writeJSON(w, code, res)
+}
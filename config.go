@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets in the output of --print-config
+const redactedSecret = "REDACTED"
+
+// duration is a time.Duration written as "5s" in the config file
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// config is the effective configuration of the service. It's built from the defaults,
+// then the json config file, then the environment, then the command line flags,
+// each overriding the previous one
+type config struct {
+	Listen        string   `json:"listen"`
+	LogLevel      string   `json:"log_level"`
+	ShutdownGrace duration `json:"shutdown_grace"`
+
+	PSQL     psqlConfig     `json:"psql"`
+	Upstream upstreamConfig `json:"upstream"`
+
+	//Workers fetch object details, Writers batch them into psql,
+	//both are the most goroutines the autoscaler runs
+	Workers     int        `json:"workers"`
+	Writers     int        `json:"writers"`
+	ChannelSize int        `json:"channel_size"`
+	Pool        poolConfig `json:"pool"`
+
+	Concurrency concurrencyConfig `json:"concurrency"`
+	RateLimit   rateLimitConfig   `json:"rate_limit"`
+
+	Callback callbackConfig `json:"callback"`
+	Queue    queueConfig    `json:"queue"`
+	Dedup    dedupConfig    `json:"dedup"`
+	Retry    retryConfig    `json:"retry"`
+	Breaker  breakerConfig  `json:"breaker"`
+	Store    storeConfig    `json:"store"`
+}
+
+type psqlConfig struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	DBName   string `json:"dbname"`
+}
+
+// stringList is a comma separated list flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// upstreamConfig is how object details are requested, URL may hold an {id} placeholder,
+// the id is appended to it otherwise
+type upstreamConfig struct {
+	URL      string            `json:"url"`
+	Method   string            `json:"method"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Auth     authConfig        `json:"auth"`
+	Response responseConfig    `json:"response"`
+	Timeout  duration          `json:"timeout"`
+	//BatchURL is an optional lookup of many ids per request
+	BatchURL  string `json:"batch_url"`
+	BatchSize int    `json:"batch_size"`
+}
+
+// authConfig is the upstream auth, none, bearer, basic or oauth2 client credentials
+type authConfig struct {
+	Kind         string   `json:"kind"`
+	Token        string   `json:"token,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	Password     string   `json:"password,omitempty"`
+	TokenURL     string   `json:"token_url,omitempty"`
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// responseConfig is how upstream responses are decoded and validated. id is always required
+// and must match the requested id, unknown fields are ignored or rejected
+type responseConfig struct {
+	Format        string   `json:"format"`
+	Required      []string `json:"required"`
+	Optional      []string `json:"optional,omitempty"`
+	UnknownFields string   `json:"unknown_fields"`
+}
+
+type poolConfig struct {
+	MinWorkers    int      `json:"min_workers"`
+	MinWriters    int      `json:"min_writers"`
+	Interval      duration `json:"interval"`
+	LatencyTarget duration `json:"latency_target"`
+}
+
+type concurrencyConfig struct {
+	Initial int      `json:"initial"`
+	Min     int      `json:"min"`
+	Max     int      `json:"max"`
+	Backoff float64  `json:"backoff"`
+	Latency duration `json:"latency"`
+}
+
+type rateConfig struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+// rateLimitConfig is the default limit of every upstream host, with Hosts overriding it per host
+type rateLimitConfig struct {
+	rateConfig
+	Hosts map[string]rateConfig `json:"hosts,omitempty"`
+}
+
+type callbackConfig struct {
+	EnqueueTimeout duration `json:"enqueue_timeout"`
+	RetryAfter     duration `json:"retry_after"`
+}
+
+type queueConfig struct {
+	Kind  string   `json:"kind"`
+	Lease duration `json:"lease"`
+	Poll  duration `json:"poll"`
+}
+
+type dedupConfig struct {
+	TTL  duration `json:"ttl"`
+	Size int      `json:"size"`
+}
+
+type retryConfig struct {
+	Attempts int      `json:"attempts"`
+	Base     duration `json:"base"`
+	Max      duration `json:"max"`
+}
+
+type breakerConfig struct {
+	Threshold int      `json:"threshold"`
+	Cooldown  duration `json:"cooldown"`
+	Probes    int      `json:"probes"`
+}
+
+type storeConfig struct {
+	History       bool     `json:"history"`
+	Unknown       bool     `json:"unknown"`
+	BatchSize     int      `json:"batch_size"`
+	BatchInterval duration `json:"batch_interval"`
+	PurgeInterval duration `json:"purge_interval"`
+	Retention     duration `json:"retention"`
+	//StateRetention purges the latest states not polled for that long, 0 keeps them
+	StateRetention duration `json:"state_retention"`
+	//StateSize bounds the object states held in memory for rules and transitions
+	StateSize int `json:"state_size"`
+	//Fields are extracted from the stored attributes into their own indexed columns
+	Fields []fieldMapping `json:"fields,omitempty"`
+	//Rules decide what happens to every fetched detail, the first matching one applies
+	Rules []ruleConfig `json:"rules"`
+}
+
+// ruleConfig stores, drops or routes To a sink the details matching When
+type ruleConfig struct {
+	Name   string `json:"name"`
+	When   string `json:"when"`
+	Action string `json:"action"`
+	To     string `json:"to,omitempty"`
+}
+
+func defaultConfig() config {
+	return config{
+		Listen:        ":9090",
+		LogLevel:      "info",
+		ShutdownGrace: duration(30 * time.Second),
+		PSQL: psqlConfig{
+			Host:     "objects",
+			Port:     "5432",
+			User:     "postgres",
+			Password: "12345",
+			DBName:   "objects",
+		},
+		Upstream: upstreamConfig{
+			URL:    "http://host.docker.internal:9010/objects/",
+			Method: http.MethodPost,
+			Response: responseConfig{
+				Format:        "json",
+				Required:      []string{"online"},
+				UnknownFields: unknownIgnore,
+			},
+			Timeout:   duration(5 * time.Second),
+			BatchSize: 100,
+		},
+		Workers:     1_000,
+		Writers:     4,
+		ChannelSize: 100,
+		Pool: poolConfig{
+			MinWorkers:    10,
+			MinWriters:    1,
+			Interval:      duration(time.Second),
+			LatencyTarget: duration(500 * time.Millisecond),
+		},
+		Concurrency: concurrencyConfig{
+			Initial: 20,
+			Min:     1,
+			Max:     1_000,
+			Backoff: 0.9,
+			//well below upstream-timeout, so slow responses cut the limit before requests time out
+			Latency: duration(2 * time.Second),
+		},
+		RateLimit: rateLimitConfig{
+			rateConfig: rateConfig{Burst: 1},
+		},
+		Callback: callbackConfig{
+			EnqueueTimeout: duration(500 * time.Millisecond),
+			RetryAfter:     duration(5 * time.Second),
+		},
+		Queue: queueConfig{
+			Kind:  "memory",
+			Lease: duration(2 * time.Minute),
+			Poll:  duration(time.Second),
+		},
+		Dedup: dedupConfig{
+			TTL:  duration(30 * time.Second),
+			Size: 100_000,
+		},
+		Retry: retryConfig{
+			Attempts: 3,
+			Base:     duration(200 * time.Millisecond),
+			Max:      duration(5 * time.Second),
+		},
+		Breaker: breakerConfig{
+			Threshold: 5,
+			Cooldown:  duration(10 * time.Second),
+			Probes:    1,
+		},
+		Store: storeConfig{
+			BatchSize:     100,
+			BatchInterval: duration(time.Second),
+			PurgeInterval: duration(5 * time.Second),
+			Retention:     duration(30 * time.Second),
+			StateSize:     100_000,
+			Rules: []ruleConfig{
+				{Name: "online", When: "online == true", Action: actionStore},
+				{Name: "unknown", When: "unknown == true", Action: actionStore},
+			},
+		},
+	}
+}
+
+// validate returns every problem with c at once
+func (c config) validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	_, err := parseLogLevel(c.LogLevel)
+	check(err == nil, "log-level must be debug, info, warn or error")
+	check(c.Listen != "", "callback listen address is required")
+	check(c.ShutdownGrace >= 0, "shutdown-grace can't be negative")
+	check(c.PSQL.Host != "" && c.PSQL.DBName != "", "psql-host and psql-db are required")
+	check(strings.HasPrefix(c.Upstream.URL, "http://") || strings.HasPrefix(c.Upstream.URL, "https://"),
+		"upstream-url must be an http(s) url")
+	check(c.Upstream.Method == http.MethodGet || c.Upstream.Method == http.MethodPost, "upstream-method must be GET or POST")
+	check(c.Upstream.Timeout > 0, "upstream-timeout must be positive")
+	_, ok := decoders[c.Upstream.Response.Format]
+	check(ok, "upstream-format must be json or xml")
+	check(c.Upstream.Response.UnknownFields == unknownIgnore || c.Upstream.Response.UnknownFields == unknownReject,
+		"upstream-unknown-fields must be ignore or reject")
+	for name := range c.Upstream.Headers {
+		check(name != "" && !strings.ContainsAny(name, " :\r\n"), fmt.Sprintf("upstream.headers: invalid header name %q", name))
+	}
+	switch auth := c.Upstream.Auth; auth.Kind {
+	case authNone:
+	case authBearer:
+		check(auth.Token != "", "upstream-token is required with bearer auth")
+	case authBasic:
+		check(auth.Username != "", "upstream-username is required with basic auth")
+	case authOAuth2:
+		check(strings.HasPrefix(auth.TokenURL, "http://") || strings.HasPrefix(auth.TokenURL, "https://"),
+			"oauth2-token-url must be an http(s) url")
+		check(auth.ClientID != "" && auth.ClientSecret != "", "oauth2-client-id and oauth2-client-secret are required with oauth2 auth")
+	default:
+		check(false, "upstream-auth must be empty, bearer, basic or oauth2")
+	}
+	check(c.Upstream.BatchURL == "" || strings.HasPrefix(c.Upstream.BatchURL, "http://") || strings.HasPrefix(c.Upstream.BatchURL, "https://"),
+		"upstream-batch-url must be an http(s) url")
+	check(c.Upstream.BatchSize > 0, "upstream-batch-size must be positive")
+	check(c.Workers > 0 && c.Writers > 0 && c.ChannelSize > 0, "workers, writers and channel-size must be positive")
+	check(c.Pool.MinWorkers > 0 && c.Pool.MinWorkers <= c.Workers && c.Pool.MinWriters > 0 && c.Pool.MinWriters <= c.Writers,
+		"min-workers and min-writers must be positive and at most workers and writers")
+	check(c.Pool.Interval > 0 && c.Pool.LatencyTarget > 0, "scale-interval and scale-latency must be positive")
+	check(c.Concurrency.Min > 0 && c.Concurrency.Min <= c.Concurrency.Initial && c.Concurrency.Initial <= c.Concurrency.Max,
+		"concurrency-min, concurrency-initial and concurrency-max must be positive and in increasing order")
+	check(c.Concurrency.Backoff > 0 && c.Concurrency.Backoff < 1 && c.Concurrency.Latency > 0,
+		"concurrency-backoff must be between 0 and 1 and concurrency-latency positive")
+	check(c.Concurrency.Latency < c.Upstream.Timeout, "concurrency-latency must be below upstream-timeout")
+	check(c.RateLimit.RPS >= 0 && c.RateLimit.Burst > 0, "rate-limit can't be negative and rate-burst must be positive")
+	for host, limit := range c.RateLimit.Hosts {
+		check(limit.RPS >= 0 && limit.Burst > 0, fmt.Sprintf("rate_limit.hosts.%s: rps can't be negative and burst must be positive", host))
+	}
+	check(c.Callback.EnqueueTimeout > 0 && c.Callback.RetryAfter > 0, "enqueue-timeout and retry-after must be positive")
+	check(c.Queue.Kind == "memory" || c.Queue.Kind == "postgres", "queue must be memory or postgres")
+	check(c.Queue.Lease > 0 && c.Queue.Poll > 0, "queue-lease and queue-poll must be positive")
+	check(c.Dedup.TTL >= 0 && c.Dedup.Size > 0, "dedup-ttl can't be negative and dedup-size must be positive")
+	//a job delivered again before its dedup claim expires would be acknowledged without being fetched
+	check(c.Queue.Kind != "postgres" || c.Queue.Lease >= c.Dedup.TTL, "queue-lease must be at least dedup-ttl with the postgres queue")
+	check(c.Retry.Attempts > 0 && c.Retry.Base >= 0 && c.Retry.Max >= c.Retry.Base,
+		"retry-attempts must be positive and retry-max at least retry-base")
+	check(c.Breaker.Threshold > 0 && c.Breaker.Cooldown > 0 && c.Breaker.Probes > 0,
+		"breaker-threshold, breaker-cooldown and breaker-probes must be positive")
+	check(c.Store.BatchSize > 0 && c.Store.BatchSize <= 10_000 && c.Store.BatchInterval > 0,
+		"batch-size (up to 10000) and batch-interval must be positive")
+	check(c.Store.PurgeInterval > 0 && c.Store.Retention > 0, "purge-interval and retention must be positive")
+	check(c.Store.StateRetention >= 0, "state-retention can't be negative")
+	check(c.Store.StateSize > 0, "state-size must be positive")
+	_, err = compileRules(c.Store.Rules)
+	check(err == nil, fmt.Sprintf("store.rules: %v", err))
+	names := make(map[string]bool)
+	for _, f := range c.Store.Fields {
+		err := f.validate()
+		check(err == nil, fmt.Sprintf("store.fields: %v", err))
+		check(!names[f.Name], fmt.Sprintf("store.fields: duplicate field %s", f.Name))
+		names[f.Name] = true
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// redacted returns a copy of c with its secrets replaced
+func (c config) redacted() config {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = redactedSecret
+		}
+	}
+
+	redact(&c.PSQL.Password)
+	redact(&c.Upstream.Auth.Token)
+	redact(&c.Upstream.Auth.Password)
+	redact(&c.Upstream.Auth.ClientSecret)
+
+	//headers may carry api keys
+	if len(c.Upstream.Headers) > 0 {
+		headers := make(map[string]string, len(c.Upstream.Headers))
+		for name, value := range c.Upstream.Headers {
+			if secretHeader(name) {
+				redact(&value)
+			}
+			headers[name] = value
+		}
+		c.Upstream.Headers = headers
+	}
+	return c
+}
+
+// secretHeader reports whether the value of header name is likely a credential
+func secretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, hint := range []string{"auth", "token", "key", "secret", "cookie"} {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// print writes c as indented json, with its secrets redacted
+func (c config) print(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.redacted())
+}
+
+// envAliases are environment variables kept from before the config file, mapped to their flag.
+// Every flag can also be set with SERVICE_ followed by its name in upper case, such as SERVICE_BATCH_SIZE
+var envAliases = []struct{ env, flag string }{
+	{"PSQL_HOST", "psql-host"},
+	{"PSQL_PORT", "psql-port"},
+	{"PSQL_USER", "psql-user"},
+	{"PSQL_PWDcas", "psql-password"},
+	{"PSQL_PASSWORD", "psql-password"},
+	{"PSQL_DB_NAME", "psql-db"},
+}
+
+// configLoader builds the config from its sources, and can build it again on reload
+// keeping the flags given on the command line
+type configLoader struct {
+	fs  *flag.FlagSet
+	cfg *config
+	//set holds the flags given on the command line
+	set map[string]string
+
+	path        string
+	printConfig bool
+}
+
+// newConfigLoader parses the command line args
+func newConfigLoader(args []string) (*configLoader, error) {
+	l := &configLoader{
+		fs:  flag.NewFlagSet("service", flag.ContinueOnError),
+		cfg: &config{},
+		set: make(map[string]string),
+	}
+	*l.cfg = defaultConfig()
+
+	fs, c := l.fs, l.cfg
+	fs.StringVar(&l.path, "config", "", "json or yaml (.yaml, .yml) config file, also set with SERVICE_CONFIG")
+	fs.BoolVar(&l.printConfig, "print-config", false, "print the effective config with secrets redacted and exit")
+
+	fs.StringVar(&c.Listen, "callback", c.Listen, "http listen address for callbacks body")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level logged: debug, info, warn or error")
+	fs.DurationVar((*time.Duration)(&c.ShutdownGrace), "shutdown-grace", time.Duration(c.ShutdownGrace), "how long queued ids are drained on shutdown before being dropped")
+
+	fs.StringVar(&c.PSQL.Host, "psql-host", c.PSQL.Host, "psql host")
+	fs.StringVar(&c.PSQL.Port, "psql-port", c.PSQL.Port, "psql port")
+	fs.StringVar(&c.PSQL.User, "psql-user", c.PSQL.User, "psql user")
+	fs.StringVar(&c.PSQL.Password, "psql-password", c.PSQL.Password, "psql password")
+	fs.StringVar(&c.PSQL.DBName, "psql-db", c.PSQL.DBName, "psql database name")
+
+	fs.StringVar(&c.Upstream.URL, "upstream-url", c.Upstream.URL, "objects api url, {id} is replaced by the object id, which is appended otherwise")
+	fs.StringVar(&c.Upstream.Method, "upstream-method", c.Upstream.Method, "http method of object detail requests, GET or POST")
+	fs.StringVar(&c.Upstream.Response.Format, "upstream-format", c.Upstream.Response.Format, "upstream response format, json or xml")
+	fs.Var((*stringList)(&c.Upstream.Response.Required), "upstream-required", "comma separated fields required in upstream responses besides id")
+	fs.Var((*stringList)(&c.Upstream.Response.Optional), "upstream-optional", "comma separated fields allowed in upstream responses besides the required ones and online")
+	fs.StringVar(&c.Upstream.Response.UnknownFields, "upstream-unknown-fields", c.Upstream.Response.UnknownFields, "ignore or reject upstream responses with unknown fields")
+	fs.StringVar(&c.Upstream.Auth.Kind, "upstream-auth", c.Upstream.Auth.Kind, "upstream auth: empty for none, bearer, basic or oauth2")
+	fs.StringVar(&c.Upstream.Auth.Token, "upstream-token", c.Upstream.Auth.Token, "upstream bearer token")
+	fs.StringVar(&c.Upstream.Auth.Username, "upstream-username", c.Upstream.Auth.Username, "upstream basic auth username")
+	fs.StringVar(&c.Upstream.Auth.Password, "upstream-password", c.Upstream.Auth.Password, "upstream basic auth password")
+	fs.StringVar(&c.Upstream.Auth.TokenURL, "oauth2-token-url", c.Upstream.Auth.TokenURL, "oauth2 token endpoint for the client credentials grant")
+	fs.StringVar(&c.Upstream.Auth.ClientID, "oauth2-client-id", c.Upstream.Auth.ClientID, "oauth2 client id")
+	fs.StringVar(&c.Upstream.Auth.ClientSecret, "oauth2-client-secret", c.Upstream.Auth.ClientSecret, "oauth2 client secret")
+	fs.Var((*stringList)(&c.Upstream.Auth.Scopes), "oauth2-scopes", "comma separated oauth2 scopes")
+	fs.DurationVar((*time.Duration)(&c.Upstream.Timeout), "upstream-timeout", time.Duration(c.Upstream.Timeout), "timeout of a single upstream request")
+	fs.StringVar(&c.Upstream.BatchURL, "upstream-batch-url", c.Upstream.BatchURL, "optional objects api url taking {\"object_ids\": [...]} and returning the details, empty to fetch ids one by one")
+	fs.IntVar(&c.Upstream.BatchSize, "upstream-batch-size", c.Upstream.BatchSize, "maximum number of ids per batch lookup")
+
+	fs.IntVar(&c.Workers, "workers", c.Workers, "maximum number of goroutines fetching object details")
+	fs.IntVar(&c.Writers, "writers", c.Writers, "maximum number of goroutines batching details into psql")
+	fs.IntVar(&c.ChannelSize, "channel-size", c.ChannelSize, "size of the job, result and error channels")
+	fs.IntVar(&c.Pool.MinWorkers, "min-workers", c.Pool.MinWorkers, "least number of goroutines fetching object details")
+	fs.IntVar(&c.Pool.MinWriters, "min-writers", c.Pool.MinWriters, "least number of goroutines batching details into psql")
+	fs.DurationVar((*time.Duration)(&c.Pool.Interval), "scale-interval", time.Duration(c.Pool.Interval), "how often the workers and writers are scaled")
+	fs.DurationVar((*time.Duration)(&c.Pool.LatencyTarget), "scale-latency", time.Duration(c.Pool.LatencyTarget), "average fetch or store latency above which the pool grows while there's a backlog")
+
+	fs.IntVar(&c.Concurrency.Initial, "concurrency-initial", c.Concurrency.Initial, "upstream requests allowed in flight at startup")
+	fs.IntVar(&c.Concurrency.Min, "concurrency-min", c.Concurrency.Min, "least upstream requests allowed in flight")
+	fs.IntVar(&c.Concurrency.Max, "concurrency-max", c.Concurrency.Max, "most upstream requests allowed in flight")
+	fs.Float64Var(&c.Concurrency.Backoff, "concurrency-backoff", c.Concurrency.Backoff, "factor the upstream concurrency limit is cut by on failures or slow responses")
+	fs.DurationVar((*time.Duration)(&c.Concurrency.Latency), "concurrency-latency", time.Duration(c.Concurrency.Latency), "upstream latency above which the concurrency limit is cut")
+
+	fs.Float64Var(&c.RateLimit.RPS, "rate-limit", c.RateLimit.RPS, "upstream requests per second per host, 0 for unlimited")
+	fs.IntVar(&c.RateLimit.Burst, "rate-burst", c.RateLimit.Burst, "upstream requests sent at once per host before rate-limit applies")
+
+	fs.DurationVar((*time.Duration)(&c.Callback.EnqueueTimeout), "enqueue-timeout", time.Duration(c.Callback.EnqueueTimeout), "how long a callback may wait for room in the queue")
+	fs.DurationVar((*time.Duration)(&c.Callback.RetryAfter), "retry-after", time.Duration(c.Callback.RetryAfter), "Retry-After sent with rejected callbacks")
+
+	fs.StringVar(&c.Queue.Kind, "queue", c.Queue.Kind, "job queue backend, memory or postgres (durable)")
+	fs.DurationVar((*time.Duration)(&c.Queue.Lease), "queue-lease", time.Duration(c.Queue.Lease), "how long a claimed durable job is hidden before it's delivered again")
+	fs.DurationVar((*time.Duration)(&c.Queue.Poll), "queue-poll", time.Duration(c.Queue.Poll), "how often an empty durable queue is polled")
+
+	fs.DurationVar((*time.Duration)(&c.Dedup.TTL), "dedup-ttl", time.Duration(c.Dedup.TTL), "how long a fetched id is suppressed before it's fetched again")
+	fs.IntVar(&c.Dedup.Size, "dedup-size", c.Dedup.Size, "maximum number of ids remembered for deduplication")
+
+	fs.IntVar(&c.Retry.Attempts, "retry-attempts", c.Retry.Attempts, "maximum number of tries per object detail fetch")
+	fs.DurationVar((*time.Duration)(&c.Retry.Base), "retry-base", time.Duration(c.Retry.Base), "initial backoff between fetch retries")
+	fs.DurationVar((*time.Duration)(&c.Retry.Max), "retry-max", time.Duration(c.Retry.Max), "maximum backoff between fetch retries")
+
+	fs.IntVar(&c.Breaker.Threshold, "breaker-threshold", c.Breaker.Threshold, "consecutive upstream failures that open the circuit breaker")
+	fs.DurationVar((*time.Duration)(&c.Breaker.Cooldown), "breaker-cooldown", time.Duration(c.Breaker.Cooldown), "how long the circuit breaker stays open before probing upstream")
+	fs.IntVar(&c.Breaker.Probes, "breaker-probes", c.Breaker.Probes, "successful probes needed to close the circuit breaker again")
+
+	fs.BoolVar(&c.Store.History, "history", c.Store.History, "also append every stored detail to the objects history table")
+	fs.BoolVar(&c.Store.Unknown, "store-unknown", c.Store.Unknown, "store objects upstream answers 404 for as unknown instead of recording them as dead letters")
+	fs.IntVar(&c.Store.BatchSize, "batch-size", c.Store.BatchSize, "maximum number of details stored per batch")
+	fs.DurationVar((*time.Duration)(&c.Store.BatchInterval), "batch-interval", time.Duration(c.Store.BatchInterval), "maximum time a detail waits before its batch is flushed")
+	fs.DurationVar((*time.Duration)(&c.Store.PurgeInterval), "purge-interval", time.Duration(c.Store.PurgeInterval), "how often rows past retention are deleted")
+	fs.DurationVar((*time.Duration)(&c.Store.Retention), "retention", time.Duration(c.Store.Retention), "how long history rows are kept")
+	fs.DurationVar((*time.Duration)(&c.Store.StateRetention), "state-retention", time.Duration(c.Store.StateRetention), "how long the latest state of an object not polled anymore is kept, 0 for forever")
+	fs.IntVar(&c.Store.StateSize, "state-size", c.Store.StateSize, "maximum number of object states remembered for filter rules and transitions")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		l.set[f.Name] = f.Value.String()
+	})
+	if l.path == "" {
+		l.path = os.Getenv("SERVICE_CONFIG")
+	}
+
+	return l, nil
+}
+
+// args returns the non-flag command line arguments
+func (l *configLoader) args() []string {
+	return l.fs.Args()
+}
+
+// load builds and validates the config from the defaults, the config file,
+// the environment and the command line flags, in that order of precedence
+func (l *configLoader) load() (config, error) {
+	*l.cfg = defaultConfig()
+
+	if l.path != "" {
+		b, err := os.ReadFile(l.path)
+		if err != nil {
+			return config{}, fmt.Errorf("error reading config file: %v", err)
+		}
+		if err := parseConfigFile(l.path, b, l.cfg); err != nil {
+			return config{}, fmt.Errorf("error parsing config file %s: %v", l.path, err)
+		}
+	}
+
+	for _, alias := range envAliases {
+		if value, ok := os.LookupEnv(alias.env); ok {
+			if err := l.fs.Set(alias.flag, value); err != nil {
+				return config{}, fmt.Errorf("invalid %s: %v", alias.env, err)
+			}
+		}
+	}
+
+	var envErr error
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		env := "SERVICE_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok && envErr == nil {
+			if err := f.Value.Set(value); err != nil {
+				envErr = fmt.Errorf("invalid %s: %v", env, err)
+			}
+		}
+	})
+	if envErr != nil {
+		return config{}, envErr
+	}
+
+	for name, value := range l.set {
+		if name == "config" || name == "print-config" {
+			continue
+		}
+		if err := l.fs.Set(name, value); err != nil {
+			return config{}, err
+		}
+	}
+
+	cfg := *l.cfg
+	return cfg, cfg.validate()
+}
+
+// parseConfigFile decodes a json config file over cfg, or a yaml one by its extension. Yaml is
+// converted to json first, so both formats use the same keys and reject unknown ones alike
+func parseConfigFile(path string, b []byte, cfg *config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var doc interface{}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return err
+		}
+		var err error
+		if b, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(cfg)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets environment variables for the duration of the test
+func setenv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		prev, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, prev)
+				return
+			}
+			os.Unsetenv(name)
+		})
+	}
+}
+
+// writeConfig writes a config file named name in a temporary directory and returns its path
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := `{"workers": 50, "writers": 3, "psql": {"host": "file-host"}}`
+
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		workers int
+		writers int
+		host    string
+	}{
+		{"defaults", "", nil, nil, 1_000, 4, "objects"},
+		{"file over defaults", file, nil, nil, 50, 3, "file-host"},
+		{"env over file", file, map[string]string{"SERVICE_WORKERS": "60", "SERVICE_PSQL_HOST": "env-host"}, nil, 60, 3, "env-host"},
+		{"alias over file", file, map[string]string{"PSQL_HOST": "alias-host"}, nil, 50, 3, "alias-host"},
+		{"service env over alias", "", map[string]string{"PSQL_HOST": "alias-host", "SERVICE_PSQL_HOST": "env-host"}, nil, 1_000, 4, "env-host"},
+		{"flag over env", file, map[string]string{"SERVICE_WORKERS": "60"}, []string{"-workers", "70"}, 70, 3, "file-host"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env)
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfig(t, "config.json", tt.file)}, args...)
+			}
+
+			l, err := newConfigLoader(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := l.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Workers != tt.workers || cfg.Writers != tt.writers || cfg.PSQL.Host != tt.host {
+				t.Errorf("workers %d, writers %d, psql host %q, want %d, %d, %q",
+					cfg.Workers, cfg.Writers, cfg.PSQL.Host, tt.workers, tt.writers, tt.host)
+			}
+		})
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path := writeConfig(t, "config.json", `{"workers": 50, "writers": 3}`)
+	l, err := newConfigLoader([]string{"-config", path, "-workers", "70"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the file changed, the flags given on the command line still win
+	if err := os.WriteFile(path, []byte(`{"workers": 80, "writers": 5}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := l.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Workers != 70 || cfg.Writers != 5 {
+		t.Errorf("workers %d, writers %d after reload, want 70, 5", cfg.Workers, cfg.Writers)
+	}
+
+	//values from a previous load don't outlive the file they came from
+	if err := os.WriteFile(path, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = l.load(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Workers != 70 || cfg.Writers != 4 {
+		t.Errorf("workers %d, writers %d after reload, want 70, 4", cfg.Workers, cfg.Writers)
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		content string
+		err     string
+	}{
+		{"json", "config.json", `{"workers": 50, "upstream": {"timeout": "3s", "headers": {"X-Api-Key": "k"}}}`, ""},
+		{"yaml", "config.yaml", "workers: 50\nupstream:\n  timeout: 3s\n  headers:\n    X-Api-Key: k\n", ""},
+		{"yml", "config.YML", "workers: 50\nupstream:\n  timeout: 3s\n  headers:\n    X-Api-Key: k\n", ""},
+		{"unknown json key", "config.json", `{"workers": 50, "wrokers": 3}`, `unknown field "wrokers"`},
+		{"unknown yaml key", "config.yaml", "workers: 50\nwrokers: 3\n", `unknown field "wrokers"`},
+		{"bad yaml", "config.yaml", "workers: [50\n", "yaml"},
+		{"yaml in a json file", "config.json", "workers: 50\n", "invalid character"},
+		{"wrong type", "config.yaml", "workers: many\n", "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		err := parseConfigFile(tt.path, []byte(tt.content), &cfg)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want it to contain %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cfg.Workers != 50 || time.Duration(cfg.Upstream.Timeout) != 3*time.Second || cfg.Upstream.Headers["X-Api-Key"] != "k" {
+			t.Errorf("%s: workers %d, timeout %v, headers %v", tt.name, cfg.Workers, time.Duration(cfg.Upstream.Timeout), cfg.Upstream.Headers)
+		}
+		//fields missing from the file keep their defaults
+		if cfg.Writers != 4 {
+			t.Errorf("%s: writers %d, want the default 4", tt.name, cfg.Writers)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Upstream.Auth = authConfig{Kind: "oauth2", Token: "t", Password: "p", ClientID: "id", ClientSecret: "s"}
+	cfg.Upstream.Headers = map[string]string{"Authorization": "Bearer t", "X-Api-Key": "k", "Accept": "application/json"}
+
+	redacted := cfg.redacted()
+
+	secrets := map[string]string{
+		"psql password":  redacted.PSQL.Password,
+		"token":          redacted.Upstream.Auth.Token,
+		"password":       redacted.Upstream.Auth.Password,
+		"client secret":  redacted.Upstream.Auth.ClientSecret,
+		"authorization":  redacted.Upstream.Headers["Authorization"],
+		"api key header": redacted.Upstream.Headers["X-Api-Key"],
+	}
+	for name, value := range secrets {
+		if value != redactedSecret {
+			t.Errorf("%s is %q, want it redacted", name, value)
+		}
+	}
+	if redacted.Upstream.Auth.ClientID != "id" || redacted.Upstream.Headers["Accept"] != "application/json" {
+		t.Errorf("non secrets were redacted: client id %q, accept %q",
+			redacted.Upstream.Auth.ClientID, redacted.Upstream.Headers["Accept"])
+	}
+
+	//empty secrets stay empty, and the original config is left alone
+	if empty := defaultConfig(); empty.redacted().Upstream.Auth.Token != "" {
+		t.Error("empty token was redacted")
+	}
+	if cfg.Upstream.Headers["X-Api-Key"] != "k" || cfg.PSQL.Password != "12345" {
+		t.Error("redacted modified the original config")
+	}
+}
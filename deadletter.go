@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pipeline stages a failure can happen at
+const (
+	stageFetch = "fetch"
+	stageStore = "store"
+)
+
+// failure is the typed record of an object that could not make it through the pipeline,
+// sent on the errChan of the client and database and persisted to dead_letters
+type failure struct {
+	ID            int64      `json:"id,omitempty"`
+	ObjectID      int        `json:"object_id"`
+	Stage         string     `json:"stage"`
+	Attempt       int        `json:"attempt"`
+	Status        int        `json:"status,omitempty"`
+	Cause         string     `json:"cause"`
+	Body          string     `json:"body,omitempty"`
+	Retryable     bool       `json:"retryable"`
+	CorrelationID string     `json:"correlation_id,omitempty"`
+	FailedAt      time.Time  `json:"failed_at"`
+	RedrivenAt    *time.Time `json:"redriven_at,omitempty"`
+
+	err error
+}
+
+func (f *failure) Error() string {
+	return fmt.Sprintf("%s failed for object %d after %d attempts: %s", f.Stage, f.ObjectID, f.Attempt, f.Cause)
+}
+
+func (f *failure) Unwrap() error {
+	return f.err
+}
+
+// class is retryable, unknown for objects upstream answered 404 for, or permanent,
+// used as a metric and log label
+func (f *failure) class() string {
+	if f.Retryable {
+		return "retryable"
+	}
+	if f.Stage == stageFetch && f.Status == http.StatusNotFound {
+		return "unknown"
+	}
+	return "permanent"
+}
+
+// fetchFailure classifies an error returned by fetchWithRetry for j
+func fetchFailure(j job, attempts int, err error) *failure {
+	f := &failure{
+		ObjectID:      j.objectID,
+		Stage:         stageFetch,
+		Attempt:       attempts,
+		Cause:         err.Error(),
+		Retryable:     err == errBreakerOpen || retryable(err),
+		CorrelationID: j.correlationID,
+		FailedAt:      time.Now().UTC(),
+		err:           err,
+	}
+
+	var status *statusError
+	if errors.As(err, &status) {
+		f.Status = status.code
+		f.Body = status.body
+	}
+	if unknownObject(err) {
+		f.Cause = "object unknown"
+	}
+	return f
+}
+
+// storeFailures records a failed batch as one failure per object it held
+func storeFailures(jobs []job, err error) []*failure {
+	now := time.Now().UTC()
+	retry := retryableStoreError(err)
+
+	failures := make([]*failure, len(jobs))
+	for i, j := range jobs {
+		failures[i] = &failure{
+			ObjectID:      j.objectID,
+			Stage:         stageStore,
+			Attempt:       1,
+			Cause:         err.Error(),
+			Retryable:     retry,
+			CorrelationID: j.correlationID,
+			FailedAt:      now,
+			err:           err,
+		}
+	}
+	return failures
+}
+
+// retryableStoreError reports whether a psql error may succeed later: connection problems,
+// serialization failures, exhausted resources and server shutdowns, as opposed to bad data
+func retryableStoreError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return true
+	}
+
+	switch pqErr.Code.Class() {
+	case "08", "40", "53", "57":
+		return true
+	}
+	return false
+}
+
+// recordFailures logs every error received on errs until it's closed,
+// persisting failure records to dead_letters
+func (db *database) recordFailures(errs <-chan error) {
+	for err := range errs {
+		var f *failure
+		if !errors.As(err, &f) {
+			logs.error(err.Error())
+			continue
+		}
+
+		log := logs.with("correlation_id", f.CorrelationID, "object_id", f.ObjectID, "stage", f.Stage)
+		log.error(f.Cause, "attempt", f.Attempt, "status", f.Status, "class", f.class())
+		deadLetters.inc(f.Stage, f.class())
+
+		if err := db.saveDeadLetter(context.Background(), f); err != nil {
+			log.error("error saving dead letter", "error", err)
+		}
+	}
+}
+
+func (db *database) saveDeadLetter(ctx context.Context, f *failure) error {
+	query := `insert into dead_letters (object_id, stage, attempt, status, cause, body, retryable, correlation_id, failed_at)
+		values($1, $2, $3, nullif($4, 0), $5, $6, $7, $8, $9)`
+
+	_, err := db.db.ExecContext(ctx, query,
+		f.ObjectID, f.Stage, f.Attempt, f.Status, f.Cause, f.Body, f.Retryable, f.CorrelationID, f.FailedAt)
+	return err
+}
+
+// listDeadLetters returns up to limit dead letters not yet redriven, oldest first
+func (db *database) listDeadLetters(ctx context.Context, limit int) ([]failure, error) {
+	query := `select id, object_id, stage, attempt, coalesce(status, 0), cause, body, retryable, correlation_id, failed_at
+		from dead_letters where redriven_at is null order by failed_at, id limit $1`
+
+	rows, err := db.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := make([]failure, 0)
+	for rows.Next() {
+		f := failure{}
+		if err := rows.Scan(&f.ID, &f.ObjectID, &f.Stage, &f.Attempt, &f.Status, &f.Cause, &f.Body,
+			&f.Retryable, &f.CorrelationID, &f.FailedAt); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// redrive queues the object ids of the given dead letters again, or of up to limit
+// pending retryable ones when ids is empty, and marks them as redriven
+func (db *database) redrive(ctx context.Context, queue jobQueue, ids []int64, limit int) (int, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `update dead_letters set redriven_at = now()
+		where id in (
+			select id from dead_letters where redriven_at is null and retryable
+			order by failed_at, id limit $1 for update skip locked
+		)
+		returning object_id, correlation_id`
+	args := []interface{}{limit}
+	if len(ids) > 0 {
+		query = `update dead_letters set redriven_at = now()
+			where redriven_at is null and id = any($1)
+			returning object_id, correlation_id`
+		args = []interface{}{pq.Array(ids)}
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	byCorrelation := make(map[string][]int)
+	for rows.Next() {
+		var (
+			objectID int
+			cid      string
+		)
+		if err := rows.Scan(&objectID, &cid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		byCorrelation[cid] = append(byCorrelation[cid], objectID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for cid, objectIDs := range byCorrelation {
+		n, err := queue.push(withCorrelationID(ctx, cid), objectIDs)
+		queued += n
+		if err != nil {
+			return queued, err
+		}
+		if n < len(objectIDs) {
+			return queued, fmt.Errorf("queue full after redriving %d dead letters", queued)
+		}
+	}
+
+	return queued, tx.Commit()
+}
+
+// deadLetterAdmin serves the dead letter admin endpoints
+type deadLetterAdmin struct {
+	db      *database
+	queue   jobQueue
+	timeout time.Duration
+}
+
+// handleList serves GET /admin/dead-letters?limit=N with the pending dead letters
+func (a *deadLetterAdmin) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	failures, err := a.db.listDeadLetters(r.Context(), limit)
+	if err != nil {
+		logFor(r.Context()).error("error listing dead letters", "error", err)
+		http.Error(w, "error listing dead letters", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		DeadLetters []failure `json:"dead_letters"`
+	}{failures})
+}
+
+// handleRedrive serves POST /admin/dead-letters/redrive, queueing the dead letters listed in
+// the optional {"ids": [...]} body again, or up to limit pending retryable ones without it.
+// When the queue fills up midway nothing is marked as redriven, and the ones already
+// queued will be queued again by the next redrive
+func (a *deadLetterAdmin) handleRedrive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := struct {
+		IDs []int64 `json:"ids"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "error decoding request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+
+	queued, err := a.db.redrive(ctx, a.queue, body.IDs, limit)
+	if err != nil {
+		logFor(r.Context()).error("error redriving dead letters", "error", err, "queued", queued)
+		http.Error(w, "error redriving dead letters", http.StatusServiceUnavailable)
+		return
+	}
+
+	logFor(r.Context()).info("redrove dead letters", "queued", queued)
+	writeJSON(w, http.StatusOK, struct {
+		Queued int `json:"queued"`
+	}{queued})
+}
+
+func parseLimit(raw string) (int, error) {
+	if raw == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, fmt.Errorf("invalid limit %q, expected 1 to %d", raw, maxPageSize)
+	}
+	return limit, nil
+}
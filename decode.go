@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// unknown field policies of a schema
+const (
+	unknownIgnore = "ignore"
+	unknownReject = "reject"
+)
+
+// decoder reads upstream responses into generic payloads, which a schema then validates.
+// Formats such as protobuf or msgpack plug in by implementing it and registering in decoders
+type decoder interface {
+	// accept is sent as the Accept header of upstream requests
+	accept() string
+	// decode reads a single object
+	decode(r io.Reader) (map[string]interface{}, error)
+	// decodeList reads the list of objects returned by a batch lookup
+	decodeList(r io.Reader) ([]map[string]interface{}, error)
+}
+
+// decoders are the upstream formats by name
+var decoders = map[string]decoder{
+	"json": jsonDecoder{},
+	"xml":  xmlDecoder{},
+}
+
+// invalidResponse is returned for upstream responses that can't be decoded or don't match the schema,
+// reason is used as a metric label
+type invalidResponse struct {
+	reason string
+	msg    string
+}
+
+func (e *invalidResponse) Error() string {
+	return "invalid upstream response: " + e.msg
+}
+
+func invalid(reason, format string, args ...interface{}) *invalidResponse {
+	responsesInvalid.inc(reason)
+	return &invalidResponse{reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+// jsonDecoder reads json objects, keeping numbers as json.Number
+type jsonDecoder struct{}
+
+func (jsonDecoder) accept() string {
+	return "application/json"
+}
+
+func (jsonDecoder) decode(r io.Reader) (map[string]interface{}, error) {
+	payload := make(map[string]interface{})
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (jsonDecoder) decodeList(r io.Reader) ([]map[string]interface{}, error) {
+	payloads := make([]map[string]interface{}, 0)
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&payloads); err != nil {
+		return nil, err
+	}
+	return payloads, nil
+}
+
+// xmlDecoder reads xml objects such as <object><id>1</id><online>true</online></object>,
+// and lists of them under any root element. Element text is read as a bool or a number
+// when it parses as one, repeated elements become lists and attributes are ignored
+type xmlDecoder struct{}
+
+func (xmlDecoder) accept() string {
+	return "application/xml"
+}
+
+func (xmlDecoder) decode(r io.Reader) (map[string]interface{}, error) {
+	dec := xml.NewDecoder(r)
+	root, err := xmlRoot(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := xmlElement(dec)
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected child elements in <%s>", root.Name.Local)
+	}
+	return payload, nil
+}
+
+func (xmlDecoder) decodeList(r io.Reader) ([]map[string]interface{}, error) {
+	dec := xml.NewDecoder(r)
+	if _, err := xmlRoot(dec); err != nil {
+		return nil, err
+	}
+
+	payloads := make([]map[string]interface{}, 0)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			value, err := xmlElement(dec)
+			if err != nil {
+				return nil, err
+			}
+			payload, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected child elements in <%s>", t.Name.Local)
+			}
+			payloads = append(payloads, payload)
+		case xml.EndElement:
+			return payloads, nil
+		}
+	}
+}
+
+// xmlRoot skips to the root element
+func xmlRoot(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+// xmlElement reads the element just started up to its end, as a map of its children or its text
+func xmlElement(dec *xml.Decoder) (interface{}, error) {
+	var (
+		text     strings.Builder
+		children map[string]interface{}
+	)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.StartElement:
+			value, err := xmlElement(dec)
+			if err != nil {
+				return nil, err
+			}
+			if children == nil {
+				children = make(map[string]interface{})
+			}
+			name := t.Name.Local
+			switch prev := children[name].(type) {
+			case nil:
+				children[name] = value
+			case []interface{}:
+				children[name] = append(prev, value)
+			default:
+				children[name] = []interface{}{prev, value}
+			}
+		case xml.EndElement:
+			if children != nil {
+				return children, nil
+			}
+			return xmlValue(strings.TrimSpace(text.String())), nil
+		}
+	}
+}
+
+// jsonNumber matches the number syntax of json, which ParseFloat is more lenient than with
+// values such as 01234, 1_000 or NaN
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+func xmlValue(text string) interface{} {
+	if text == "true" || text == "false" {
+		return text == "true"
+	}
+	if jsonNumber.MatchString(text) {
+		return json.Number(text)
+	}
+	return text
+}
+
+// schema validates decoded payloads before they become object details
+type schema struct {
+	required []string
+	known    map[string]bool
+	policy   string
+	fields   []fieldMapping
+}
+
+// newSchema requires id and the given fields, knows the optional and mapped ones besides,
+// and checks the types of mapped fields
+func newSchema(cfg responseConfig, fields []fieldMapping) schema {
+	s := schema{
+		required: append([]string{"id"}, cfg.Required...),
+		known:    map[string]bool{"id": true, "online": true},
+		policy:   cfg.UnknownFields,
+		fields:   fields,
+	}
+	for _, f := range fields {
+		s.known[f.segments()[0]] = true
+	}
+	for _, field := range s.required {
+		s.known[field] = true
+	}
+	for _, field := range cfg.Optional {
+		s.known[field] = true
+	}
+	return s
+}
+
+// detail validates payload and returns the detail it describes
+func (s schema) detail(payload map[string]interface{}) (ObjectDetail, error) {
+	for _, field := range s.required {
+		if _, ok := payload[field]; !ok {
+			return ObjectDetail{}, invalid("missing", "missing required field %q", field)
+		}
+	}
+
+	if s.policy == unknownReject {
+		var unknown []string
+		for field := range payload {
+			if !s.known[field] {
+				unknown = append(unknown, field)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return ObjectDetail{}, invalid("unknown", "unknown fields %s", strings.Join(unknown, ", "))
+		}
+	}
+
+	detail := ObjectDetail{}
+	n, ok := payload["id"].(json.Number)
+	if !ok {
+		return ObjectDetail{}, invalid("type", "id must be a number, got %T", payload["id"])
+	}
+	id, err := strconv.ParseInt(n.String(), 10, 0)
+	if err != nil {
+		return ObjectDetail{}, invalid("type", "id must be an integer, got %s", n)
+	}
+	detail.ID = int(id)
+
+	if online, ok := payload["online"]; ok {
+		b, ok := online.(bool)
+		if !ok {
+			return ObjectDetail{}, invalid("type", "online must be a bool, got %T", online)
+		}
+		detail.Online = b
+	}
+
+	for _, f := range s.fields {
+		if value, ok := f.lookup(payload); ok {
+			if err := f.check(value); err != nil {
+				return ObjectDetail{}, invalid("type", "%v", err)
+			}
+		}
+	}
+
+	detail.Attributes = payload
+	//checked here so a payload that can't be stored fails on its own instead of the whole batch it's stored in
+	if _, err := detail.attributes(); err != nil {
+		return ObjectDetail{}, invalid("encode", "%v", err)
+	}
+	return detail, nil
+}
+
+// decodeDetail decodes and validates the response for objectID
+func (c *client) decodeDetail(r io.Reader, objectID int) (ObjectDetail, error) {
+	payload, err := c.decoder.decode(r)
+	if err != nil {
+		return ObjectDetail{}, invalid("decode", "%v", err)
+	}
+
+	detail, err := c.schema.detail(payload)
+	if err != nil {
+		return ObjectDetail{}, err
+	}
+	if detail.ID != objectID {
+		return ObjectDetail{}, invalid("mismatch", "requested object %d, got %d", objectID, detail.ID)
+	}
+	return detail, nil
+}
+
+// decodeDetails decodes the response of a batch lookup, skipping the invalid objects
+// and the ones that weren't requested, so that they're fetched on their own
+func (c *client) decodeDetails(r io.Reader, objectIDs []int) ([]ObjectDetail, error) {
+	payloads, err := c.decoder.decodeList(r)
+	if err != nil {
+		return nil, invalid("decode", "%v", err)
+	}
+
+	requested := make(map[int]bool, len(objectIDs))
+	for _, id := range objectIDs {
+		requested[id] = true
+	}
+
+	details := make([]ObjectDetail, 0, len(payloads))
+	for _, payload := range payloads {
+		detail, err := c.schema.detail(payload)
+		if err == nil && !requested[detail.ID] {
+			err = invalid("mismatch", "object %d wasn't requested", detail.ID)
+		}
+		if err != nil {
+			logs.warn("skipping object in batch response", "error", err)
+			continue
+		}
+		details = append(details, detail)
+	}
+	return details, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupCache suppresses object ids that were fetched within the last ttl,
+// holding at most size ids and evicting the least recently claimed one beyond that
+type dedupCache struct {
+	ttl  time.Duration
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	items map[int]*list.Element
+}
+
+type dedupEntry struct {
+	id      int
+	claimed time.Time
+}
+
+func newDedupCache(ttl time.Duration, size int) *dedupCache {
+	return &dedupCache{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		items: make(map[int]*list.Element),
+	}
+}
+
+// claim reports whether id should be fetched, which is the case when it was never
+// claimed or its last claim expired, and marks it as fresh if so
+func (d *dedupCache) claim(id int) bool {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.items[id]; ok {
+		entry := el.Value.(*dedupEntry)
+		if now.Sub(entry.claimed) < d.ttl {
+			return false
+		}
+		entry.claimed = now
+		d.order.MoveToFront(el)
+		return true
+	}
+
+	d.items[id] = d.order.PushFront(&dedupEntry{id: id, claimed: now})
+	for d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.items, oldest.Value.(*dedupEntry).id)
+	}
+	return true
+}
+
+// forget drops the claim on id, so that it's fetched again the next time it's received
+func (d *dedupCache) forget(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.items[id]; ok {
+		d.order.Remove(el)
+		delete(d.items, id)
+	}
+}
+
+// len returns the number of ids currently held
+func (d *dedupCache) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.order.Len()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// fieldTypes maps the types of field mappings to their psql column type
+var fieldTypes = map[string]string{
+	"text":    "text",
+	"integer": "bigint",
+	"numeric": "numeric",
+	"boolean": "boolean",
+}
+
+var (
+	fieldName    = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+	fieldSegment = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// fieldMapping extracts a typed column from the attributes of an object. Path is dotted, such as
+// battery.level, and the column is generated by psql as attr_ followed by Name, with an index
+type fieldMapping struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+}
+
+func (f fieldMapping) column() string {
+	return "attr_" + f.Name
+}
+
+func (f fieldMapping) segments() []string {
+	return strings.Split(f.Path, ".")
+}
+
+func (f fieldMapping) validate() error {
+	if !fieldName.MatchString(f.Name) {
+		return fmt.Errorf("invalid field name %q, expected lower case letters, digits and _", f.Name)
+	}
+	switch f.Name {
+	case "online", "since", "limit", "cursor":
+		return fmt.Errorf("field name %s is taken by a /objects filter", f.Name)
+	}
+	for _, segment := range f.segments() {
+		if !fieldSegment.MatchString(segment) {
+			return fmt.Errorf("invalid path %q of field %s", f.Path, f.Name)
+		}
+	}
+	if _, ok := fieldTypes[f.Type]; !ok {
+		return fmt.Errorf("invalid type %q of field %s, expected text, integer, numeric or boolean", f.Type, f.Name)
+	}
+	return nil
+}
+
+// expression is the psql expression generating the column from the attributes
+func (f fieldMapping) expression() string {
+	path := pq.QuoteLiteral("{" + strings.Join(f.segments(), ",") + "}")
+	return fmt.Sprintf("((attributes #>> %s)::%s)", path, fieldTypes[f.Type])
+}
+
+// lookup returns the value at the path of f in payload
+func (f fieldMapping) lookup(payload map[string]interface{}) (interface{}, bool) {
+	var value interface{} = payload
+	for _, segment := range f.segments() {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// check reports whether value can be cast to the type of f by psql, so a bad value
+// fails validation instead of the whole batch it's stored in
+func (f fieldMapping) check(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	ok := false
+	switch f.Type {
+	case "text":
+		switch value.(type) {
+		case string, json.Number, bool:
+			ok = true
+		}
+	case "integer":
+		if n, isNumber := value.(json.Number); isNumber {
+			_, err := strconv.ParseInt(n.String(), 10, 64)
+			ok = err == nil
+		}
+	case "numeric":
+		_, ok = value.(json.Number)
+	case "boolean":
+		_, ok = value.(bool)
+	}
+	if !ok {
+		return fmt.Errorf("%s must be %s, got %v", f.Path, f.Type, value)
+	}
+	return nil
+}
+
+// parse reads a filter value of f given in a query string
+func (f fieldMapping) parse(raw string) (interface{}, error) {
+	var err error
+	switch f.Type {
+	case "integer":
+		_, err = strconv.ParseInt(raw, 10, 64)
+	case "numeric":
+		_, err = strconv.ParseFloat(raw, 64)
+	case "boolean":
+		var b bool
+		b, err = strconv.ParseBool(raw)
+		if err == nil {
+			return b, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q, expected %s", f.Name, raw, f.Type)
+	}
+	return raw, nil
+}
+
+// syncFields adds the generated columns and indexes of the field mappings missing from object_state.
+// Columns of removed mappings are kept, and changing the type of a mapping needs its column dropped by hand
+func (db *database) syncFields(ctx context.Context) error {
+	return db.withMigrationLock(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `select column_name, data_type from information_schema.columns
+			where table_schema = current_schema() and table_name = 'object_state' and column_name like 'attr\_%'`)
+		if err != nil {
+			return err
+		}
+		existing := make(map[string]string)
+		for rows.Next() {
+			var column, dataType string
+			if err := rows.Scan(&column, &dataType); err != nil {
+				rows.Close()
+				return err
+			}
+			existing[column] = dataType
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, f := range db.fields {
+			column := f.column()
+			if dataType, ok := existing[column]; ok {
+				if dataType != fieldTypes[f.Type] {
+					return fmt.Errorf("column %s is %s, drop it to map field %s as %s", column, dataType, f.Name, f.Type)
+				}
+				continue
+			}
+
+			query := fmt.Sprintf("alter table object_state add column %s %s generated always as %s stored",
+				pq.QuoteIdentifier(column), fieldTypes[f.Type], f.expression())
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("error adding column %s: %v", column, err)
+			}
+			query = fmt.Sprintf("create index if not exists %s on object_state (%s)",
+				pq.QuoteIdentifier("object_state_"+column+"_idx"), pq.QuoteIdentifier(column))
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("error indexing column %s: %v", column, err)
+			}
+			logs.info("added mapped field", "field", f.Name, "column", column, "path", f.Path, "type", f.Type)
+		}
+		return nil
+	})
+}
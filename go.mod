@@ -2,4 +2,7 @@ module github.com/lets_Go/service
 
 go 1.16
 
-require github.com/lib/pq v1.10.0
+require (
+	github.com/lib/pq v1.10.0
+	gopkg.in/yaml.v3 v3.0.1
+)
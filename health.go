@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// health is the body served by /healthz
+type health struct {
+	Status   string `json:"status"`
+	Database string `json:"database"`
+	Upstream string `json:"upstream"`
+}
+
+// healthHandler serves GET /healthz, responding 503 when psql is unreachable
+// and reporting the service as degraded while the upstream breaker isn't closed
+func healthHandler(db *database, cli *client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		h := health{Status: "ok", Database: "ok", Upstream: cli.breaker.current().String()}
+		code := http.StatusOK
+
+		if err := db.db.PingContext(ctx); err != nil {
+			h.Status, h.Database = "unavailable", err.Error()
+			code = http.StatusServiceUnavailable
+		} else if h.Upstream != breakerClosed.String() {
+			h.Status = "degraded"
+		}
+
+		writeJSON(w, code, h)
+	}
+}
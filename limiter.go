@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter is an AIMD concurrency limit on upstream requests. Every request that succeeds
+// within latency raises the limit by 1/limit, so about one per limit's worth of requests,
+// and a retryable failure or a slower response cuts it by backoff, at most once per latency
+type limiter struct {
+	min, max float64
+	backoff  float64
+	latency  time.Duration
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	cutAt    time.Time
+	//changed is closed and replaced whenever a slot may have freed up
+	changed chan struct{}
+}
+
+func newLimiter(initial, min, max int, backoff float64, latency time.Duration) *limiter {
+	return &limiter{
+		min:     float64(min),
+		max:     float64(max),
+		backoff: backoff,
+		latency: latency,
+		limit:   float64(initial),
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire blocks until a request may be sent or ctx is done,
+// otherwise the caller must report the outcome with release
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// release frees the slot of a request that took rtt and failed with err, adjusting the limit
+func (l *limiter) release(rtt time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	switch {
+	case (err != nil && retryable(err)) || rtt > l.latency:
+		//requests sent before the last cut were already counted by it
+		if time.Since(l.cutAt) > l.latency {
+			l.limit *= l.backoff
+			l.cutAt = time.Now()
+		}
+	case err == nil:
+		l.limit += 1 / l.limit
+	}
+	if l.limit < l.min {
+		l.limit = l.min
+	}
+	if l.limit > l.max {
+		l.limit = l.max
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// current returns the limit and the requests in flight
+func (l *limiter) current() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit), l.inflight
+}
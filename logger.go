@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for l := levelDebug; l <= levelError; l++ {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+// logger writes one json object per line with a timestamp, level, message
+// and the key value pairs passed along, dropping entries below its level
+type logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// logOutput is shared by a logger and the loggers derived from it with with()
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int32
+}
+
+var logs = newLogger(os.Stderr, levelInfo)
+
+func newLogger(w io.Writer, level logLevel) *logger {
+	return &logger{out: &logOutput{w: w, level: int32(level)}}
+}
+
+// setLevel changes the level of l and every logger derived from it
+func (l *logger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&l.out.level)
+}
+
+// with returns a logger adding the key value pairs kv to every entry
+func (l *logger) with(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{out: l.out, fields: fields}
+}
+
+func (l *logger) debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// fatal logs at error level and exits
+func (l *logger) fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeLogValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeLogValue(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeLogValue(&buf, msg)
+
+	for _, fields := range [][]interface{}{l.fields, kv} {
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeLogValue(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			if i+1 < len(fields) {
+				writeLogValue(&buf, fields[i+1])
+			} else {
+				buf.WriteString("null")
+			}
+		}
+	}
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeLogValue(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case error:
+		v = value.Error()
+	case fmt.Stringer:
+		v = value.String()
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+	buf.Write(b)
+}
+
+type correlationKey struct{}
+
+// newCorrelationID returns a random id tying together the log entries of one callback
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// logFor returns the logger for ctx, tagged with its correlation id if any
+func logFor(ctx context.Context) *logger {
+	if id := correlationID(ctx); id != "" {
+		return logs.with("correlation_id", id)
+	}
+	return logs
+}
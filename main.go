@@ -3,10 +3,9 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
@@ -24,33 +23,66 @@ type ObjectList struct {
 
 // ObjectDetail holds the status of a single ID stored in postgres
 type ObjectDetail struct {
-	ID       int  `json:"id"`
-	Online   bool `json:"online"`
-	LastSeen time.Time
+	ID       int       `json:"id"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"lastseen"`
+	//Unknown objects were answered 404 by upstream
+	Unknown bool `json:"unknown,omitempty"`
+	//Attributes is the full upstream payload
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
 }
 
 type database struct {
 	db      *sql.DB
 	errChan chan error
+	//history also appends every stored detail to the objects table
+	history bool
+	//fields are extracted from the attributes into their own columns
+	fields []fieldMapping
+	//rules decide which details are stored, given the last stored states
+	rules    ruleSet
+	states   *stateTracker
+	observed *stateTracker
+	//forget releases the dedup claim on an object whose detail couldn't be stored, so it's fetched again
+	forget func(objectID int)
+
+	batchSize     int
+	batchInterval time.Duration
+	//purgeInterval, retention and stateRetention are nanoseconds, changed live on reload
+	purgeInterval  int64
+	retention      int64
+	stateRetention int64
 }
 
 type client struct {
-	cli     *http.Client
-	workers int
-	path    string
 	errChan chan error
-	seen    map[int]struct{}
+	seen    *dedupCache
 
-	sync.RWMutex
-}
+	retry   retryPolicy
+	breaker *breaker
+	limiter *limiter
+	rate    *rateLimits
 
-var (
-	host     = getenv("PSQL_HOST", "objects")
-	port     = getenv("PSQL_PORT", "5432")
-	user     = getenv("PSQL_USER", "postgres")
-	password = getenv("PSQL_PWDcas", "12345")
-	dbname   = getenv("PSQL_DB_NAME", "objects")
-)
+	//storeUnknown stores objects upstream answers 404 for instead of recording a failure
+	storeUnknown bool
+
+	//method, headers and auth shape every upstream request, decoder and schema read its response
+	method  string
+	headers http.Header
+	auth    authorizer
+	decoder decoder
+	schema  schema
+
+	//batchPath is the optional batch lookup, turned off by batchOff once it's found missing
+	batchPath string
+	batchSize int
+	batchOff  int32
+
+	//cli and path are replaced on reload
+	mu   sync.RWMutex
+	cli  *http.Client
+	path string
+}
 
 //new list of object ids
 func newObjectList() *ObjectList {
@@ -59,116 +91,238 @@ func newObjectList() *ObjectList {
 	}
 }
 
-//new http client for posting to path
-func newHTTPClient(count int) *client {
+//new http client for requesting object details from path
+func newHTTPClient(cfg config) *client {
+	headers := make(http.Header, len(cfg.Upstream.Headers))
+	for name, value := range cfg.Upstream.Headers {
+		headers.Set(name, value)
+	}
+
 	return &client{
 		cli: &http.Client{
-			Timeout: time.Second * 5,
+			Timeout: time.Duration(cfg.Upstream.Timeout),
 		},
-		workers: count,
 		//can be different size
-		errChan: make(chan error, count),
-		seen:    make(map[int]struct{}),
-		path:    "http://host.docker.internal:9010/objects/",
+		errChan: make(chan error, cfg.ChannelSize),
+		seen:    newDedupCache(time.Duration(cfg.Dedup.TTL), cfg.Dedup.Size),
+		path:    cfg.Upstream.URL,
+
+		method:  cfg.Upstream.Method,
+		headers: headers,
+		auth:    newAuthorizer(cfg.Upstream.Auth, time.Duration(cfg.Upstream.Timeout)),
+		decoder: decoders[cfg.Upstream.Response.Format],
+		schema:  newSchema(cfg.Upstream.Response, cfg.Store.Fields),
+
+		batchPath: cfg.Upstream.BatchURL,
+		batchSize: cfg.Upstream.BatchSize,
+
+		retry: retryPolicy{
+			attempts: cfg.Retry.Attempts,
+			base:     time.Duration(cfg.Retry.Base),
+			max:      time.Duration(cfg.Retry.Max),
+		},
+		breaker: newBreaker(cfg.Breaker.Threshold, time.Duration(cfg.Breaker.Cooldown), cfg.Breaker.Probes),
+
+		storeUnknown: cfg.Store.Unknown,
+		limiter: newLimiter(cfg.Concurrency.Initial, cfg.Concurrency.Min, cfg.Concurrency.Max,
+			cfg.Concurrency.Backoff, time.Duration(cfg.Concurrency.Latency)),
+		rate: newRateLimits(cfg.RateLimit),
 	}
 }
 
 //new psql database connection
-func newDatabase(count int) (*database, error) {
+func newDatabase(cfg config) (*database, error) {
 	db, err := sql.Open("postgres", fmt.Sprintf(`host=%s port=%s user=%s
 		password=%s dbname=%s sslmode=disable`,
-		host, port, user, password, dbname))
+		cfg.PSQL.Host, cfg.PSQL.Port, cfg.PSQL.User, cfg.PSQL.Password, cfg.PSQL.DBName))
 	if err != nil {
 		return nil, err
 	}
 	if err := db.Ping(); err != nil {
 		return nil, err
 	}
-	log.Printf("connected to psql client, host: %s\n", host)
+	logs.info("connected to psql client", "host", cfg.PSQL.Host)
+
+	rules, err := compileRules(cfg.Store.Rules)
+	if err != nil {
+		return nil, err
+	}
 
 	return &database{
 		db:      db,
-		errChan: make(chan error, count),
+		errChan: make(chan error, cfg.ChannelSize),
+		history: cfg.Store.History,
+		fields:  cfg.Store.Fields,
+		rules:   rules,
+		states:  newStateTracker(cfg.Store.StateSize),
+		//observed is updated with every fetched detail, stored or not
+		observed: newStateTracker(cfg.Store.StateSize),
+		forget:   func(int) {},
+
+		batchSize:      cfg.Store.BatchSize,
+		batchInterval:  time.Duration(cfg.Store.BatchInterval),
+		purgeInterval:  int64(cfg.Store.PurgeInterval),
+		retention:      int64(cfg.Store.Retention),
+		stateRetention: int64(cfg.Store.StateRetention),
 	}, nil
 }
 
 func main() {
-	db, err := newDatabase(100)
+	loader, err := newConfigLoader(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Fatal("error connecting to psql", err)
+		logs.fatal("invalid flags", "error", err)
+	}
+
+	cfg, err := loader.load()
+	if loader.printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			logs.fatal("error printing config", "error", err)
+		}
+	}
+	if err != nil {
+		logs.fatal("error loading config", "error", err)
+	}
+	if loader.printConfig {
+		return
 	}
 
-	objList := newObjectList()
-	cli := newHTTPClient(100)
+	level, _ := parseLogLevel(cfg.LogLevel)
+	logs.setLevel(level)
 
-	callbackAddr := flag.String("callback", ":9090", "http listen address for callbacks body")
-	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
+
+	db, err := newDatabase(cfg)
+	if err != nil {
+		logs.fatal("error connecting to psql", "error", err)
+	}
+
+	//migrate subcommand: service migrate up|down [steps]|status
+	if args := loader.args(); len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(context.Background(), db, args[1:]); err != nil {
+			logs.fatal("error running migrations", "error", err)
+		}
+		return
+	}
+
+	applied, err := db.migrateUp(context.Background())
+	if err != nil {
+		logs.fatal("error applying migrations", "error", err)
+	}
+	for _, m := range applied {
+		logs.info("applied migration", "version", m.version, "name", m.name)
+	}
+	if err := db.syncFields(context.Background()); err != nil {
+		logs.fatal("error adding mapped fields", "error", err)
+	}
+	if err := db.loadStates(context.Background()); err != nil {
+		logs.fatal("error loading object states", "error", err)
+	}
+
+	cli := newHTTPClient(cfg)
+	db.forget = cli.seen.forget
 
 	errChan := make(chan error)
 
-	//handle shutdown signals
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-sig)
-	}()
+	//handle shutdown signals, and reload the config on SIGHUP
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	jobs := make(chan int, cli.workers)
-	result := make(chan ObjectDetail, cli.workers)
+	queue, err := newJobQueue(cfg.Queue.Kind, cfg.ChannelSize, db, time.Duration(cfg.Queue.Lease), time.Duration(cfg.Queue.Poll))
+	if err != nil {
+		logs.fatal("error creating job queue", "error", err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	for i := 0; i < 1_000; i++ {
-		go cli.worker(ctx, jobs, result)
-	}
-
-	go cli.errors()
+	//the pool starts at its least size and grows with the backlog
+	p := newPipeline(cli, db, queue, cfg.ChannelSize)
+	scaler := newAutoscaler(p, cfg)
+	go scaler.run()
 
-	//receive object ids from /callback path
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		if r.Body == nil {
-			log.Println("nil request body")
-			http.Error(w, "no request body found", http.StatusBadRequest)
+	r := &reloader{loader: loader, current: cfg, scaler: scaler, cli: cli, db: db}
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				r.reload()
+				continue
+			}
+			errChan <- fmt.Errorf("%s", s)
 			return
 		}
+	}()
 
-		if err := json.NewDecoder(r.Body).Decode(&objList); err != nil {
-			log.Println("error decoding request")
-			http.Error(w, "error decoding request", http.StatusBadRequest)
-			return
-		}
+	var recording sync.WaitGroup
+	recording.Add(2)
+	go func() {
+		defer recording.Done()
+		db.recordFailures(cli.errChan)
+	}()
 
-		for i := range objList.ObjectIDs {
-			jobs <- objList.ObjectIDs[i]
-		}
-	})
+	//receive object ids from /callback path
+	enqueueTimeout := time.Duration(cfg.Callback.EnqueueTimeout)
+	in := newIngester(queue, enqueueTimeout, time.Duration(cfg.Callback.RetryAfter), cli.breaker)
+	http.HandleFunc("/callback", in.handleCallback)
 
-	for i := 0; i < 500; i++ {
-		go db.filter(ctx, result)
-	}
+	http.HandleFunc("/healthz", healthHandler(db, cli))
 
-	go db.errors()
+	registerGauges(db, cli, p)
+	http.Handle("/metrics", metrics)
+
+	//inspect and redrive failed objects
+	admin := &deadLetterAdmin{db: db, queue: queue, timeout: enqueueTimeout}
+	http.HandleFunc("/admin/dead-letters", admin.handleList)
+	http.HandleFunc("/admin/dead-letters/redrive", admin.handleRedrive)
+
+	//read stored statuses
+	http.HandleFunc("/objects", db.handleObjects)
+	http.HandleFunc("/objects/", db.handleObject)
+
+	go func() {
+		defer recording.Done()
+		db.recordFailures(db.errChan)
+	}()
 
-	go db.deleteDetail(ctx)
+	purged := make(chan struct{})
+	go func() {
+		defer close(purged)
+		db.deleteDetail(ctx)
+	}()
 
 	//listening for callback
+	srv := &http.Server{Addr: cfg.Listen}
 	go func() {
-		log.Printf("listening on port %s for callback\n", *callbackAddr)
-		if err := http.ListenAndServe(*callbackAddr, nil); err != nil {
+		logs.info("listening for callback", "addr", cfg.Listen)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			errChan <- err
-			cancel()
 		}
 	}()
 
-	log.Println("exit: ", <-errChan)
-	close(jobs)
-	close(result)
-}
+	logs.info("exit", "reason", <-errChan)
+
+	//stop accepting callbacks, drain queued ids, flush pending writes, then close the psql pool
+	deadline := time.Now().Add(time.Duration(cfg.ShutdownGrace))
+	shutdownCtx, cancelShutdown := context.WithDeadline(context.Background(), deadline)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logs.error("error shutting down http server", "error", err)
+	}
+
+	scaler.shutdown()
+	dropped := p.shutdown(time.Until(deadline))
+	cancel()
+	<-purged
+
+	//nothing sends failures anymore, record the pending ones before closing the pool
+	close(cli.errChan)
+	close(db.errChan)
+	recording.Wait()
 
-func getenv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+	if err := db.db.Close(); err != nil {
+		logs.error("error closing psql pool", "error", err)
 	}
-	return fallback
+	logs.info("shutdown complete", "dropped_jobs", dropped)
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric family written in the prometheus text format
+type collector interface {
+	collect(w io.Writer)
+}
+
+// registry holds every metric served on /metrics
+type registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+var metrics = &registry{}
+
+func (r *registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// ServeHTTP serves GET /metrics
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.collect(buf)
+	}
+	buf.Flush()
+}
+
+// series is the set of label values of a metric, keyed by their joined values
+type series struct {
+	labels []string
+	keys   []string
+}
+
+func (s *series) key(values []string) string {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(s.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// format renders the label pairs for key, with extra appended as is
+func (s *series) format(key string, extra string) string {
+	pairs := make([]string, 0, len(s.labels)+1)
+	if len(s.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", s.labels[i], value))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter is a monotonically increasing value per set of label values
+type counter struct {
+	name, help string
+	series
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{
+		name:   name,
+		help:   help,
+		series: series{labels: labels},
+		values: make(map[string]float64),
+	}
+	metrics.register(c)
+	return c
+}
+
+func (c *counter) inc(labels ...string) {
+	c.add(1, labels...)
+}
+
+func (c *counter) add(v float64, labels ...string) {
+	key := c.key(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.values[key]; !ok {
+		c.keys = append(c.keys, key)
+		sort.Strings(c.keys)
+	}
+	c.values[key] += v
+}
+
+func (c *counter) value(labels ...string) float64 {
+	key := c.key(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[key]
+}
+
+func (c *counter) collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.keys) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(key, ""), formatFloat(c.values[key]))
+	}
+}
+
+// gaugeFunc is a value read when collected
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	metrics.register(g)
+	return g
+}
+
+func (g *gaugeFunc) collect(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+// histogram counts observations in cumulative buckets per set of label values
+type histogram struct {
+	name, help string
+	buckets    []float64
+	series
+
+	mu     sync.Mutex
+	values map[string]*histogramValues
+}
+
+type histogramValues struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// latencyBuckets are the default buckets in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		series:  series{labels: labels},
+		values:  make(map[string]*histogramValues),
+	}
+	metrics.register(h)
+	return h
+}
+
+func (h *histogram) observe(v float64, labels ...string) {
+	key := h.key(labels)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	values, ok := h.values[key]
+	if !ok {
+		values = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = values
+		h.keys = append(h.keys, key)
+		sort.Strings(h.keys)
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			values.counts[i]++
+		}
+	}
+	values.sum += v
+	values.count++
+}
+
+// totals returns the sum and count of the observations of every series
+func (h *histogram) totals() (float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var (
+		sum   float64
+		count uint64
+	)
+	for _, values := range h.values {
+		sum += values.sum
+		count += values.count
+	}
+	return sum, count
+}
+
+func (h *histogram) collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range h.keys {
+		values := h.values[key]
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf("le=%q", formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, le), values.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, `le="+Inf"`), values.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(key, ""), formatFloat(values.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(key, ""), values.count)
+	}
+}
+
+// pipeline metrics, gauges reading live state are registered in main
+var (
+	callbacksReceived = newCounter("service_callbacks_total", "Callbacks received, by response code.", "code")
+	idsEnqueued       = newCounter("service_ids_enqueued_total", "Object ids accepted into the job queue.")
+	idsRejected       = newCounter("service_ids_rejected_total", "Object ids rejected by /callback.")
+	idsDeduped        = newCounter("service_ids_deduped_total", "Object ids skipped because their last result is still fresh.")
+	jobsDropped       = newCounter("service_jobs_dropped_total", "Jobs abandoned on shutdown.")
+
+	fetchDuration    = newHistogram("service_fetch_duration_seconds", "Latency of upstream object detail fetches, by status code.", latencyBuckets, "code")
+	rateLimitWait    = newHistogram("service_rate_limit_wait_seconds", "Time spent waiting for a rate limit token, by upstream host.", latencyBuckets, "host")
+	responsesInvalid = newCounter("service_invalid_responses_total", "Upstream responses rejected by the decoder or schema, by reason.", "reason")
+	fetchFailures    = newCounter("service_fetch_failures_total", "Object ids that could not be fetched after every attempt, by upstream status code and class.", "code", "class")
+	deadLetters      = newCounter("service_dead_letters_total", "Failures recorded as dead letters, by stage and class.", "stage", "class")
+
+	storeDuration    = newHistogram("service_store_duration_seconds", "Latency of storing a batch of details.", latencyBuckets)
+	storeBatches     = newCounter("service_store_batches_total", "Batches stored, by result.", "result")
+	storeRows        = newCounter("service_store_rows_total", "Details stored, by result.", "result")
+	ruleHits         = newCounter("service_rule_hits_total", "Fetched details matched by each filter rule, by rule and action.", "rule", "action")
+	transitionEvents = newCounter("service_transitions_total", "Objects going online or offline, by event.", "event")
+	rowsPurged       = newCounter("service_rows_purged_total", "Rows deleted past retention by deleteDetail, by table.", "table")
+)
+
+// registerGauges registers the gauges reading the live state of the pipeline and psql pool
+func registerGauges(db *database, cli *client, p *pipeline) {
+	newGaugeFunc("service_queue_depth", "Jobs buffered for the workers.", func() float64 {
+		return float64(p.queue.depth())
+	})
+	newGaugeFunc("service_result_depth", "Fetched details waiting for the filter stage.", func() float64 {
+		return float64(len(p.result))
+	})
+	newGaugeFunc("service_pool_workers", "Fetch worker goroutines running, sized by the autoscaler.", func() float64 {
+		return float64(p.workers.size())
+	})
+	newGaugeFunc("service_pool_writers", "Filter goroutines running, sized by the autoscaler.", func() float64 {
+		return float64(p.writers.size())
+	})
+	newGaugeFunc("service_upstream_concurrency_limit", "Upstream requests allowed in flight by the adaptive limiter.", func() float64 {
+		limit, _ := cli.limiter.current()
+		return float64(limit)
+	})
+	newGaugeFunc("service_upstream_inflight", "Upstream requests in flight.", func() float64 {
+		_, inflight := cli.limiter.current()
+		return float64(inflight)
+	})
+	newGaugeFunc("service_tracked_objects", "Objects whose last stored state filter rules compare to.", func() float64 {
+		return float64(db.states.len())
+	})
+	newGaugeFunc("service_dedup_size", "Object ids held by the dedup cache.", func() float64 {
+		return float64(cli.seen.len())
+	})
+	newGaugeFunc("service_breaker_state", "Upstream circuit breaker state, 0 closed, 1 open, 2 half-open.", func() float64 {
+		return float64(cli.breaker.current())
+	})
+
+	newGaugeFunc("service_db_open_connections", "Open psql connections.", func() float64 {
+		return float64(db.db.Stats().OpenConnections)
+	})
+	newGaugeFunc("service_db_in_use_connections", "psql connections in use.", func() float64 {
+		return float64(db.db.Stats().InUse)
+	})
+	newGaugeFunc("service_db_idle_connections", "Idle psql connections.", func() float64 {
+		return float64(db.db.Stats().Idle)
+	})
+	newGaugeFunc("service_db_wait_count", "Total connections waited for.", func() float64 {
+		return float64(db.db.Stats().WaitCount)
+	})
+	newGaugeFunc("service_db_wait_duration_seconds", "Total time spent waiting for a connection.", func() float64 {
+		return db.db.Stats().WaitDuration.Seconds()
+	})
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the advisory lock key held while migrations run,
+// so that several replicas starting at once apply them only once
+const migrationLock = 7_310_001
+
+// migration is a single versioned schema change with its rollback
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrationStatus reports whether a migration has been applied
+type migrationStatus struct {
+	migration
+	appliedAt *time.Time
+}
+
+// loadMigrations reads the embedded migrations/NNNN_name.{up,down}.sql files
+// ordered by version
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, file := range files {
+		base := strings.TrimPrefix(file, "migrations/")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name %q", base)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q: %v", base, err)
+		}
+
+		body, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version}
+			byVersion[version] = m
+		}
+
+		switch {
+		case strings.HasSuffix(parts[1], ".up.sql"):
+			m.name = strings.TrimSuffix(parts[1], ".up.sql")
+			m.up = string(body)
+		case strings.HasSuffix(parts[1], ".down.sql"):
+			m.down = string(body)
+		default:
+			return nil, fmt.Errorf("migration %q must end in .up.sql or .down.sql", base)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+// withMigrationLock runs fn in a transaction holding the migration lock,
+// creating the schema_migrations bookkeeping table if needed
+func (db *database) withMigrationLock(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock($1)", migrationLock); err != nil {
+		return fmt.Errorf("error acquiring migration lock: %v", err)
+	}
+
+	query := `create table if not exists schema_migrations (
+		version integer primary key,
+		name text not null,
+		applied_at timestamp with time zone not null default now()
+	)`
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("error creating schema_migrations: %v", err)
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// appliedMigrations returns the applied versions and when they were applied
+func appliedMigrations(ctx context.Context, tx *sql.Tx) (map[int]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, "select version, applied_at from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies every pending migration in order and returns the ones applied
+func (db *database) migrateUp(ctx context.Context) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	err = db.withMigrationLock(ctx, func(tx *sql.Tx) error {
+		applied, err := appliedMigrations(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, m.up); err != nil {
+				return fmt.Errorf("error applying migration %d_%s: %v", m.version, m.name, err)
+			}
+			query := "insert into schema_migrations (version, name) values($1, $2)"
+			if _, err := tx.ExecContext(ctx, query, m.version, m.name); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// migrateDown rolls back the latest steps applied migrations and returns them
+func (db *database) migrateDown(ctx context.Context, steps int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	err = db.withMigrationLock(ctx, func(tx *sql.Tx) error {
+		applied, err := appliedMigrations(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if m.down == "" {
+				return fmt.Errorf("migration %d_%s has no down script", m.version, m.name)
+			}
+			if _, err := tx.ExecContext(ctx, m.down); err != nil {
+				return fmt.Errorf("error reverting migration %d_%s: %v", m.version, m.name, err)
+			}
+			query := "delete from schema_migrations where version = $1"
+			if _, err := tx.ExecContext(ctx, query, m.version); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// migrationStatuses lists every known migration and when it was applied, if at all
+func (db *database) migrationStatuses(ctx context.Context) ([]migrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []migrationStatus
+	err = db.withMigrationLock(ctx, func(tx *sql.Tx) error {
+		applied, err := appliedMigrations(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			status := migrationStatus{migration: m}
+			if appliedAt, ok := applied[m.version]; ok {
+				status.appliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// runMigrate implements the `migrate up|down [steps]|status` subcommand
+func runMigrate(ctx context.Context, db *database, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := db.migrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range done {
+			fmt.Printf("applied %04d_%s\n", m.version, m.name)
+		}
+		if len(done) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		done, err := db.migrateDown(ctx, steps)
+		if err != nil {
+			return err
+		}
+		for _, m := range done {
+			fmt.Printf("reverted %04d_%s\n", m.version, m.name)
+		}
+		if len(done) == 0 {
+			fmt.Println("no applied migrations")
+		}
+	case "status":
+		statuses, err := db.migrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.appliedAt != nil {
+				applied = "applied " + s.appliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.version, s.name, applied)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+create table if not exists objects (
+    id integer,
+    online bool,
+    lastseen timestamp with time zone
+);
@@ -0,0 +1,2 @@
+drop index if exists objects_id_lastseen_idx;
+drop table if exists object_state;
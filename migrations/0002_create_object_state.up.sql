@@ -0,0 +1,15 @@
+-- latest known status per object, upserted on every poll
+create table object_state (
+    id integer primary key,
+    online bool not null,
+    lastseen timestamp with time zone not null
+);
+
+insert into object_state (id, online, lastseen)
+select distinct on (id) id, coalesce(online, false), lastseen
+from objects
+where id is not null and lastseen is not null
+order by id, lastseen desc;
+
+-- objects is kept as the optional append-only history table
+create index objects_id_lastseen_idx on objects (id, lastseen);
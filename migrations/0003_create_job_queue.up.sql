@@ -0,0 +1,10 @@
+-- durable queue of object ids received on /callback, consumed with select ... for update skip locked
+create table job_queue (
+    seq bigserial primary key,
+    object_id integer not null,
+    enqueued_at timestamp with time zone not null default now(),
+    available_at timestamp with time zone not null default now(),
+    attempts integer not null default 0
+);
+
+create index job_queue_available_at_idx on job_queue (available_at);
@@ -0,0 +1 @@
+alter table job_queue drop column if exists correlation_id;
@@ -0,0 +1,2 @@
+-- correlation id of the callback a job was received on
+alter table job_queue add column correlation_id text not null default '';
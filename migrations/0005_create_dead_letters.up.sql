@@ -0,0 +1,15 @@
+-- objects that failed to be fetched or stored, kept until redriven
+create table dead_letters (
+    id bigserial primary key,
+    object_id integer not null,
+    stage text not null,
+    attempt integer not null,
+    status integer,
+    cause text not null,
+    retryable bool not null,
+    correlation_id text not null default '',
+    failed_at timestamp with time zone not null default now(),
+    redriven_at timestamp with time zone
+);
+
+create index dead_letters_pending_idx on dead_letters (failed_at) where redriven_at is null;
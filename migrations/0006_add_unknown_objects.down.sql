@@ -0,0 +1,3 @@
+alter table dead_letters drop column if exists body;
+alter table objects drop column if exists unknown;
+alter table object_state drop column if exists unknown;
@@ -0,0 +1,5 @@
+-- objects the upstream answered 404 for, stored when store.unknown is set
+alter table object_state add column unknown bool not null default false;
+alter table objects add column unknown bool not null default false;
+-- truncated body of the upstream error response
+alter table dead_letters add column body text not null default '';
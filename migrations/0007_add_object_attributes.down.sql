@@ -0,0 +1,3 @@
+-- cascades to the generated attr_ columns
+alter table objects drop column if exists attributes cascade;
+alter table object_state drop column if exists attributes cascade;
@@ -0,0 +1,3 @@
+-- full upstream payload of every object, mapped fields are added as generated attr_ columns on startup
+alter table object_state add column attributes jsonb not null default '{}';
+alter table objects add column attributes jsonb not null default '{}';
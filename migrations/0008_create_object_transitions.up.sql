@@ -0,0 +1,12 @@
+-- online/offline state changes of objects, kept past the retention of object_state
+create table object_transitions (
+    id bigserial primary key,
+    object_id integer not null,
+    event text not null check (event in ('went_online', 'went_offline')),
+    at timestamp with time zone not null,
+    since timestamp with time zone not null,
+    duration_ms bigint not null,
+    correlation_id text not null default ''
+);
+
+create index object_transitions_object_id_at_idx on object_transitions (object_id, at);
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// minFlushTimeout is the least time the filter stage gets to flush pending writes on shutdown,
+// even when draining the queue used up the whole grace period
+const minFlushTimeout = 5 * time.Second
+
+// pipeline wires the job queue, the fetch workers and the filter stage together
+type pipeline struct {
+	cli    *client
+	db     *database
+	queue  jobQueue
+	result chan outcome
+
+	fetchCtx     context.Context
+	stopFetching context.CancelFunc
+	storeCtx     context.Context
+	stopStoring  context.CancelFunc
+
+	workers *group
+	writers *group
+}
+
+func newPipeline(cli *client, db *database, queue jobQueue, size int) *pipeline {
+	p := &pipeline{
+		cli:    cli,
+		db:     db,
+		queue:  queue,
+		result: make(chan outcome, size),
+	}
+	p.fetchCtx, p.stopFetching = context.WithCancel(context.Background())
+	p.storeCtx, p.stopStoring = context.WithCancel(context.Background())
+
+	p.workers = newGroup(func(stop <-chan struct{}) {
+		if p.cli.batchPath != "" {
+			p.cli.batchWorker(p.fetchCtx, stop, p.queue.jobs(), p.result)
+			return
+		}
+		p.cli.worker(p.fetchCtx, stop, p.queue.jobs(), p.result)
+	})
+	p.writers = newGroup(func(stop <-chan struct{}) {
+		p.db.filter(p.storeCtx, stop, p.result, p.queue)
+	})
+	return p
+}
+
+// resize runs workers fetch workers and writers filter goroutines
+func (p *pipeline) resize(workers, writers int) {
+	p.workers.resize(workers)
+	p.writers.resize(writers)
+}
+
+// shutdown stops taking jobs from the queue, lets the workers drain what was already
+// queued for up to grace, flushes the filter stage, and returns how many jobs were dropped
+func (p *pipeline) shutdown(grace time.Duration) int64 {
+	deadline := time.Now().Add(grace)
+
+	p.queue.close()
+	if !waitTimeout(&p.workers.wg, grace) {
+		logs.warn("shutdown grace period expired, dropping remaining jobs", "grace", grace)
+		p.stopFetching()
+		p.workers.wg.Wait()
+	}
+
+	//nothing sends to result anymore
+	close(p.result)
+
+	flushTimeout := time.Until(deadline)
+	if flushTimeout < minFlushTimeout {
+		flushTimeout = minFlushTimeout
+	}
+	if !waitTimeout(&p.writers.wg, flushTimeout) {
+		logs.warn("pending writes not flushed in time, abandoning them", "timeout", flushTimeout)
+		p.stopStoring()
+		p.writers.wg.Wait()
+	}
+
+	p.stopFetching()
+	p.stopStoring()
+
+	return int64(jobsDropped.value())
+}
+
+// waitTimeout waits for wg for up to timeout and reports whether it finished
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -2,59 +2,245 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// group runs a resizable number of goroutines, each one stopped through its own channel
+type group struct {
+	run func(stop <-chan struct{})
+
+	mu    sync.Mutex
+	stops []chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newGroup(run func(stop <-chan struct{})) *group {
+	return &group{run: run}
+}
+
+// resize starts or stops goroutines until n are running, stopped ones finish their current work first
+func (g *group) resize(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for len(g.stops) < n {
+		stop := make(chan struct{})
+		g.stops = append(g.stops, stop)
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.run(stop)
+		}()
+	}
+	for len(g.stops) > n {
+		last := len(g.stops) - 1
+		close(g.stops[last])
+		g.stops = g.stops[:last]
+	}
+}
+
+// size returns the number of goroutines running
+func (g *group) size() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.stops)
+}
+
 //worker blocks until the object ids are available, and sends gotten details to result
-func (c *client) worker(ctx context.Context, jobs <-chan int, result chan<- ObjectDetail) {
-	for objectID := range jobs {
-		c.RLock()
-		_, ok := c.seen[objectID]
-		c.RUnlock()
-		if ok {
-			continue
+//until stop or jobs is closed
+func (c *client) worker(ctx context.Context, stop <-chan struct{}, jobs <-chan job, result chan<- outcome) {
+	for {
+		var j job
+		select {
+		case <-stop:
+			return
+		case next, ok := <-jobs:
+			if !ok {
+				return
+			}
+			j = next
 		}
 
-		c.Lock()
-		c.seen[objectID] = struct{}{}
-		c.Unlock()
+		//past the shutdown grace period, drain what's left without fetching
+		if ctx.Err() != nil {
+			jobsDropped.inc()
+			continue
+		}
 
-		detail, err := c.fetchDetail(ctx, objectID)
-		if err != nil {
-			c.errChan <- err
+		//skip ids whose last result is still fresh
+		if !c.seen.claim(j.objectID) {
+			idsDeduped.inc()
+			result <- outcome{job: j}
 			continue
 		}
 
-		detail.LastSeen = time.Now().UTC()
-		result <- detail
+		c.fetchJob(ctx, j, result)
 	}
 }
 
-func (c *client) errors() {
-	for err := range c.errChan {
-		log.Println(err)
+// fetchJob fetches the detail of a claimed job and sends its outcome to result
+func (c *client) fetchJob(ctx context.Context, j job, result chan<- outcome) {
+	jobCtx := withCorrelationID(ctx, j.correlationID)
+	detail, attempts, err := c.fetchWithRetry(jobCtx, j.objectID)
+	if err != nil && c.storeUnknown && unknownObject(err) {
+		fetchFailures.inc(strconv.Itoa(http.StatusNotFound), "unknown")
+		logFor(jobCtx).info("object unknown to upstream, storing it as such", "object_id", j.objectID)
+		detail = ObjectDetail{ID: j.objectID, Unknown: true}
+		err = nil
+	}
+	if err != nil {
+		c.fetchFailed(ctx, j, attempts, err, result)
+		return
 	}
+
+	detail.LastSeen = time.Now().UTC()
+	result <- outcome{job: j, detail: detail, fetched: true}
 }
 
-//filter pulls the details sent to the result channel by worker()
-func (db *database) filter(ctx context.Context, result <-chan ObjectDetail) {
-	for detail := range result {
-		if !detail.Online {
-			continue
+// fetchFailed reports a job that couldn't be fetched
+func (c *client) fetchFailed(ctx context.Context, j job, attempts int, err error, result chan<- outcome) {
+	if err == errBreakerOpen {
+		//left unacknowledged, so a durable queue delivers it again
+		c.seen.forget(j.objectID)
+		c.errChan <- fetchFailure(j, attempts, err)
+		return
+	}
+	if ctx.Err() != nil {
+		jobsDropped.inc()
+		return
+	}
+
+	f := fetchFailure(j, attempts, err)
+	code := "error"
+	if f.Status != 0 {
+		code = strconv.Itoa(f.Status)
+	}
+
+	c.seen.forget(j.objectID)
+	fetchFailures.inc(code, f.class())
+	c.errChan <- f
+	result <- outcome{job: j}
+}
+
+// filter pulls the outcomes sent to the result channel by worker(), and stores or routes
+// the details db.rules match in batches of up to db.batchSize, flushing early every db.batchInterval.
+// Jobs are acknowledged to the queue once their batch is stored. It returns once stop or result is closed
+func (db *database) filter(ctx context.Context, stop <-chan struct{}, result <-chan outcome, queue jobQueue) {
+	batch := make([]ObjectDetail, 0, db.batchSize)
+	pending := make([]outcome, 0, db.batchSize)
+	done := make([]job, 0, db.batchSize)
+	stored := make([]job, 0, db.batchSize)
+	history := make([]ObjectDetail, 0)
+	historyJobs := make([]job, 0)
+	transitions := make([]transition, 0)
+
+	//jobs that couldn't be stored are fetched again when redriven or delivered again,
+	//the ones abandoned past the shutdown flush timeout are dropped
+	storeFailed := func(jobs []job, err error) {
+		if ctx.Err() != nil {
+			jobsDropped.add(float64(len(jobs)))
+			return
+		}
+		for _, f := range storeFailures(jobs, err) {
+			db.forget(f.ObjectID)
+			db.errChan <- f
 		}
+	}
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if ctx.Err() != nil {
+			jobsDropped.add(float64(len(pending)))
+			pending = pending[:0]
+			return
+		}
+
+		batch, done, stored = batch[:0], done[:0], stored[:0]
+		history, historyJobs, transitions = history[:0], historyJobs[:0], transitions[:0]
+		for _, out := range pending {
+			done = append(done, out.job)
+			if !out.fetched {
+				continue
+			}
 
-		if err := db.toStore(ctx, detail); err != nil {
+			if t, ok := db.observed.observe(out.detail); ok {
+				t.CorrelationID = out.job.correlationID
+				transitions = append(transitions, t)
+			}
+
+			prev, known := db.states.get(out.detail.ID)
+			r := db.rules.match(out.detail, prev, known)
+			switch {
+			case r.action == actionStore:
+				batch = append(batch, out.detail)
+				stored = append(stored, out.job)
+			case r.action == actionRoute && r.sink == sinkHistory:
+				history = append(history, out.detail)
+				historyJobs = append(historyJobs, out.job)
+			case r.action == actionRoute && r.sink == sinkLog:
+				logs.info("routed object", "rule", r.name, "correlation_id", out.job.correlationID,
+					"object_id", out.detail.ID, "online", out.detail.Online, "lastseen", out.detail.LastSeen)
+			}
+		}
+
+		pending = pending[:0]
+
+		//transitions are observed once, so they're logged and saved whatever happens to the details they came with
+		for _, t := range transitions {
+			transitionEvents.inc(t.Event)
+			logs.info(t.Event, "correlation_id", t.CorrelationID, "object_id", t.ObjectID,
+				"at", t.At, "since", t.Since, "duration_ms", t.DurationMS)
+		}
+		if err := db.saveTransitions(ctx, transitions); err != nil {
+			db.errChan <- err
+		}
+
+		if err := db.flush(ctx, batch); err != nil {
+			storeFailed(stored, err)
+			return
+		}
+		db.states.set(batch)
+
+		if err := db.appendHistory(ctx, history); err != nil {
+			storeFailed(historyJobs, err)
+			return
+		}
+
+		for i, detail := range batch {
+			logs.debug("stored object", "correlation_id", stored[i].correlationID,
+				"object_id", detail.ID, "online", detail.Online, "lastseen", detail.LastSeen)
+		}
+		if err := queue.ack(ctx, done); err != nil {
 			db.errChan <- err
-			continue
 		}
-		fmt.Printf("%+v\n", detail)
 	}
-}
 
-func (db *database) errors() {
-	for err := range db.errChan {
-		log.Println(err)
+	ticker := time.NewTicker(db.batchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case out, ok := <-result:
+			if !ok {
+				flush()
+				return
+			}
+
+			pending = append(pending, out)
+			if len(pending) >= db.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			flush()
+			return
+		}
 	}
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// job is an object id taken from the queue, seq identifies it in a durable queue
+// and attempts which delivery of it this is, so only the latest claim can acknowledge it
+type job struct {
+	objectID      int
+	seq           int64
+	attempts      int
+	correlationID string
+}
+
+// outcome is what a worker made of a job, passed on to the filter stage so the job
+// can be acknowledged once stored. fetched is false when there's nothing to store
+type outcome struct {
+	job     job
+	detail  ObjectDetail
+	fetched bool
+}
+
+// jobQueue feeds the object ids received on /callback to the workers
+type jobQueue interface {
+	// push queues ids until ctx is done, returning how many were queued,
+	// tagged with the correlation id of ctx
+	push(ctx context.Context, ids []int) (int, error)
+	// jobs is the channel the workers consume from, closed once the queue is closed
+	jobs() <-chan job
+	// depth returns the number of jobs buffered for the workers
+	depth() int
+	// ack marks jobs as processed, durable queues deliver unacknowledged jobs again
+	ack(ctx context.Context, jobs []job) error
+	// close stops delivering jobs
+	close()
+}
+
+// newJobQueue returns the queue backend selected by kind, "memory" or "postgres"
+func newJobQueue(kind string, size int, db *database, lease, poll time.Duration) (jobQueue, error) {
+	switch kind {
+	case "memory":
+		return newMemQueue(size), nil
+	case "postgres":
+		return newPgQueue(db, size, lease, poll), nil
+	}
+	return nil, fmt.Errorf("unknown queue %q, expected memory or postgres", kind)
+}
+
+// errQueueClosed is returned for ids pushed once the queue is closed on shutdown
+var errQueueClosed = errors.New("job queue closed")
+
+// memQueue is a channel, jobs are lost on restart
+type memQueue struct {
+	ch chan job
+
+	//closing stops pushes waiting for room, and mu keeps ch from being closed under them
+	closing chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+}
+
+func newMemQueue(size int) *memQueue {
+	return &memQueue{ch: make(chan job, size), closing: make(chan struct{})}
+}
+
+func (q *memQueue) push(ctx context.Context, ids []int) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return 0, errQueueClosed
+	}
+
+	cid := correlationID(ctx)
+	for i, id := range ids {
+		select {
+		case q.ch <- job{objectID: id, correlationID: cid}:
+		case <-ctx.Done():
+			return i, nil
+		case <-q.closing:
+			return i, errQueueClosed
+		}
+	}
+	return len(ids), nil
+}
+
+func (q *memQueue) jobs() <-chan job {
+	return q.ch
+}
+
+func (q *memQueue) depth() int {
+	return len(q.ch)
+}
+
+func (q *memQueue) ack(ctx context.Context, jobs []job) error {
+	return nil
+}
+
+func (q *memQueue) close() {
+	close(q.closing)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	close(q.ch)
+}
+
+// pgQueue keeps jobs in the job_queue table. Jobs are claimed with select ... for update
+// skip locked, hidden for lease while being processed, and deleted once acknowledged,
+// so each one is delivered at least once
+type pgQueue struct {
+	db    *database
+	lease time.Duration
+	poll  time.Duration
+	batch int
+
+	ch     chan job
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+func newPgQueue(db *database, size int, lease, poll time.Duration) *pgQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	q := &pgQueue{
+		db:     db,
+		lease:  lease,
+		poll:   poll,
+		batch:  size,
+		ch:     make(chan job, size),
+		cancel: cancel,
+	}
+
+	q.done.Add(1)
+	go q.run(ctx)
+
+	return q
+}
+
+func (q *pgQueue) push(ctx context.Context, ids []int) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	objectIDs := make([]int64, len(ids))
+	for i, id := range ids {
+		objectIDs[i] = int64(id)
+	}
+
+	//a single array parameter, so any number of ids fits in the statement
+	query := "insert into job_queue (object_id, correlation_id) select unnest($2::int[]), $1"
+	if _, err := q.db.db.ExecContext(ctx, query, correlationID(ctx), pq.Array(objectIDs)); err != nil {
+		return 0, fmt.Errorf("error queueing object ids: %v", err)
+	}
+	return len(ids), nil
+}
+
+func (q *pgQueue) jobs() <-chan job {
+	return q.ch
+}
+
+func (q *pgQueue) depth() int {
+	return len(q.ch)
+}
+
+func (q *pgQueue) ack(ctx context.Context, jobs []job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	seqs := make([]int64, len(jobs))
+	attempts := make([]int64, len(jobs))
+	for i := range jobs {
+		seqs[i] = jobs[i].seq
+		attempts[i] = int64(jobs[i].attempts)
+	}
+
+	//a job whose lease expired was claimed again, by this or another instance, and is the new claim's to acknowledge
+	query := `delete from job_queue q using unnest($1::bigint[], $2::integer[]) as d(seq, attempts)
+		where q.seq = d.seq and q.attempts = d.attempts`
+	if _, err := q.db.db.ExecContext(ctx, query, pq.Array(seqs), pq.Array(attempts)); err != nil {
+		return fmt.Errorf("error acknowledging %d jobs: %v", len(jobs), err)
+	}
+	return nil
+}
+
+func (q *pgQueue) close() {
+	q.cancel()
+	q.done.Wait()
+}
+
+// run claims available jobs and hands them to the workers until ctx is done
+func (q *pgQueue) run(ctx context.Context) {
+	defer q.done.Done()
+	defer close(q.ch)
+
+	for {
+		jobs, err := q.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			q.db.errChan <- err
+		}
+
+		for _, j := range jobs {
+			select {
+			case q.ch <- j:
+			case <-ctx.Done():
+				//unsent jobs are delivered again once their lease expires
+				return
+			}
+		}
+
+		if len(jobs) == 0 {
+			select {
+			case <-time.After(q.poll):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// claim leases up to q.batch available jobs
+func (q *pgQueue) claim(ctx context.Context) ([]job, error) {
+	query := `update job_queue set available_at = now() + make_interval(secs => $2), attempts = attempts + 1
+		where seq in (
+			select seq from job_queue where available_at <= now()
+			order by seq limit $1 for update skip locked
+		)
+		returning seq, attempts, object_id, correlation_id`
+
+	rows, err := q.db.db.QueryContext(ctx, query, q.batch, q.lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error claiming jobs: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []job
+	for rows.Next() {
+		j := job{}
+		if err := rows.Scan(&j.seq, &j.attempts, &j.objectID, &j.correlationID); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
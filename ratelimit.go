@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate requests per second on average, and up to burst at once
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before it may be used
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	//tokens go negative while requests are waiting for them
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back a reserved token that wasn't used
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens++
+}
+
+// rateLimits are the token buckets of every upstream host, using the default limit
+// for hosts without their own. A zero rate means unlimited
+type rateLimits struct {
+	def   rateConfig
+	hosts map[string]rateConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimits(cfg rateLimitConfig) *rateLimits {
+	return &rateLimits{
+		def:     cfg.rateConfig,
+		hosts:   cfg.Hosts,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (r *rateLimits) bucket(host string) *tokenBucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, ok := r.buckets[host]; ok {
+		return b
+	}
+
+	cfg, ok := r.hosts[host]
+	if !ok {
+		cfg = r.def
+	}
+	var b *tokenBucket
+	if cfg.RPS > 0 {
+		b = newTokenBucket(cfg.RPS, cfg.Burst)
+	}
+	r.buckets[host] = b
+	return b
+}
+
+// wait blocks until a request may be sent to host or ctx is done
+func (r *rateLimits) wait(ctx context.Context, host string) error {
+	b := r.bucket(host)
+	if b == nil {
+		return nil
+	}
+
+	delay := b.reserve()
+	rateLimitWait.observe(delay.Seconds(), host)
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// reloadable are the config keys applied live on SIGHUP, changing any other one needs a restart
+var reloadable = map[string]bool{
+	"log_level":             true,
+	"workers":               true,
+	"writers":               true,
+	"pool.min_workers":      true,
+	"pool.min_writers":      true,
+	"upstream.url":          true,
+	"upstream.timeout":      true,
+	"store.purge_interval":  true,
+	"store.retention":       true,
+	"store.state_retention": true,
+}
+
+// configChange is a config key whose value changed on reload
+type configChange struct {
+	key      string
+	old, new string
+}
+
+// reloader reads the config again on SIGHUP, and applies the changes that are safe to apply live
+type reloader struct {
+	loader  *configLoader
+	current config
+
+	scaler *autoscaler
+	cli    *client
+	db     *database
+}
+
+// reload applies the reloadable changes of a valid config, logging what changed,
+// and rejects invalid configs as a whole
+func (r *reloader) reload() {
+	next, err := r.loader.load()
+	if err != nil {
+		logs.error("rejected config reload", "error", err)
+		return
+	}
+
+	changes, err := diffConfig(r.current, next)
+	if err != nil {
+		logs.error("rejected config reload", "error", err)
+		return
+	}
+	if len(changes) == 0 {
+		logs.info("config reloaded, nothing changed")
+		return
+	}
+
+	for _, change := range changes {
+		if !reloadable[change.key] {
+			logs.warn("config change needs a restart", "key", change.key, "old", change.old, "new", change.new)
+			continue
+		}
+		logs.info("applying config change", "key", change.key, "old", change.old, "new", change.new)
+	}
+
+	//only the reloadable keys move on, so the others keep being reported until a restart
+	applied := r.current
+	applied.LogLevel = next.LogLevel
+	applied.Workers, applied.Writers = next.Workers, next.Writers
+	applied.Pool.MinWorkers, applied.Pool.MinWriters = next.Pool.MinWorkers, next.Pool.MinWriters
+	applied.Upstream.URL, applied.Upstream.Timeout = next.Upstream.URL, next.Upstream.Timeout
+	applied.Store.PurgeInterval, applied.Store.Retention = next.Store.PurgeInterval, next.Store.Retention
+	applied.Store.StateRetention = next.Store.StateRetention
+
+	level, _ := parseLogLevel(applied.LogLevel)
+	logs.setLevel(level)
+	r.scaler.setBounds(applied)
+	r.cli.setUpstream(applied.Upstream.URL, time.Duration(applied.Upstream.Timeout))
+	r.db.setRetention(time.Duration(applied.Store.PurgeInterval), time.Duration(applied.Store.Retention),
+		time.Duration(applied.Store.StateRetention))
+
+	r.current = applied
+}
+
+// diffConfig returns the keys that differ between old and new, sorted, with secrets redacted
+func diffConfig(old, new config) ([]configChange, error) {
+	before, err := flattenConfig(old.redacted())
+	if err != nil {
+		return nil, err
+	}
+	after, err := flattenConfig(new.redacted())
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []configChange
+	for key, value := range after {
+		if before[key] != value {
+			changes = append(changes, configChange{key: key, old: before[key], new: value})
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, configChange{key: key, old: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].key < changes[j].key
+	})
+	return changes, nil
+}
+
+// flattenConfig maps the dotted json path of every value in cfg to its json encoding
+func flattenConfig(cfg config) (map[string]string, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return nil, err
+	}
+
+	flat := make(map[string]string)
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			for key, child := range m {
+				if prefix != "" {
+					key = prefix + "." + key
+				}
+				walk(key, child)
+			}
+			return
+		}
+		b, _ := json.Marshal(v)
+		flat[prefix] = string(b)
+	}
+	walk("", tree)
+
+	return flat, nil
+}
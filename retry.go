@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryAfter caps how long a Retry-After header can hold a worker
+const maxRetryAfter = time.Minute
+
+// retryPolicy describes how failed fetches are retried
+type retryPolicy struct {
+	//attempts is the maximum number of tries, including the first one
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+// backoff returns the wait before retry number attempt (starting at 1),
+// exponential in attempt with full jitter and capped at p.max
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.base << uint(attempt-1)
+	if ceiling <= 0 || ceiling > p.max {
+		ceiling = p.max
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// maxErrorBody is how much of an upstream error response is kept
+const maxErrorBody = 512
+
+// statusError is returned for non-2xx upstream responses
+type statusError struct {
+	code       int
+	retryAfter time.Duration
+	//body is the start of the response, error pages can be large
+	body string
+}
+
+// newStatusError reads the start of the body of a non-2xx response
+func newStatusError(resp *http.Response) *statusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &statusError{
+		code:       resp.StatusCode,
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		body:       strings.ToValidUTF8(strings.TrimSpace(string(body)), ""),
+	}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("upstream responded %d %s", e.code, http.StatusText(e.code))
+}
+
+// unknownObject reports whether upstream answered that the object doesn't exist
+func unknownObject(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) && status.code == http.StatusNotFound
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// canceled reports whether err is the caller giving up, such as workers stopped on shutdown, which says
+// nothing about upstream. send returns the error of the caller's ctx as is, so http client timeouts don't match
+func canceled(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// retryable reports whether err is worth another attempt: connection errors and timeouts, 5xx, 408 and 429.
+// Other statuses, the caller giving up, and request errors such as tls or redirect ones are permanent
+func retryable(err error) bool {
+	if canceled(err) {
+		return false
+	}
+
+	var auth *authError
+	if errors.As(err, &auth) {
+		return auth.temporary
+	}
+
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code >= 500 || status.code == http.StatusTooManyRequests || status.code == http.StatusRequestTimeout
+	}
+
+	//every error of the http client is a *url.Error, and a net.Error itself, so only what it wraps tells
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// fetchWithRetry fetches an object detail, retrying according to c.retry,
+// and returns the number of attempts made
+func (c *client) fetchWithRetry(ctx context.Context, objectID int) (ObjectDetail, int, error) {
+	var detail ObjectDetail
+	attempts, err := c.withRetry(ctx, func() error {
+		var err error
+		detail, err = c.fetchDetail(ctx, objectID)
+		return err
+	})
+	return detail, attempts, err
+}
+
+// withRetry calls fetch through the breaker until it succeeds, retrying according to c.retry,
+// and returns the number of attempts made
+func (c *client) withRetry(ctx context.Context, fetch func() error) (int, error) {
+	attempt := 0
+	for {
+		attempt++
+
+		//fail fast without retrying while upstream is unhealthy
+		probe, err := c.breaker.allow()
+		if err != nil {
+			return attempt, err
+		}
+
+		err = fetch()
+		c.breaker.done(probe, err)
+		if err == nil {
+			return attempt, nil
+		}
+		if attempt >= c.retry.attempts || !retryable(err) || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		wait := c.retry.backoff(attempt)
+		var status *statusError
+		if errors.As(err, &status) && status.retryAfter > wait {
+			wait = status.retryAfter
+			if wait > maxRetryAfter {
+				wait = maxRetryAfter
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// rule actions
+const (
+	actionStore = "store"
+	actionDrop  = "drop"
+	actionRoute = "route"
+)
+
+// route sinks, details routed to history are appended to the objects table without
+// updating their state, details routed to log are only logged
+const (
+	sinkHistory = "history"
+	sinkLog     = "log"
+)
+
+// defaultRule is the name counted for details no rule matched, which are dropped
+const defaultRule = "default"
+
+// rule decides what happens to the details its expression matches
+type rule struct {
+	name   string
+	when   expr
+	action string
+	sink   string
+}
+
+// ruleSet is the filter stage rules, evaluated in order until one matches
+type ruleSet []rule
+
+// compileRules parses the rules of the config
+func compileRules(cfgs []ruleConfig) (ruleSet, error) {
+	rules := make(ruleSet, 0, len(cfgs))
+	names := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || cfg.Name == defaultRule || names[cfg.Name] {
+			return nil, fmt.Errorf("rule names must be unique and not empty or %q, got %q", defaultRule, cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		when, err := parseExpr(cfg.When)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", cfg.Name, err)
+		}
+
+		switch cfg.Action {
+		case actionStore, actionDrop:
+			if cfg.To != "" {
+				return nil, fmt.Errorf("rule %s: only route takes a sink", cfg.Name)
+			}
+		case actionRoute:
+			if cfg.To != sinkHistory && cfg.To != sinkLog {
+				return nil, fmt.Errorf("rule %s: route sink must be history or log, got %q", cfg.Name, cfg.To)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: action must be store, drop or route, got %q", cfg.Name, cfg.Action)
+		}
+
+		rules = append(rules, rule{name: cfg.Name, when: when, action: cfg.Action, sink: cfg.To})
+	}
+	return rules, nil
+}
+
+// match returns the first rule matching detail given the previous state of its object
+func (rs ruleSet) match(detail ObjectDetail, prev objectState, known bool) rule {
+	env := ruleEnv{detail: detail, prev: prev, known: known}
+	for _, r := range rs {
+		if b, ok := r.when.eval(env).(bool); ok && b {
+			ruleHits.inc(r.name, r.action)
+			return r
+		}
+	}
+	ruleHits.inc(defaultRule, actionDrop)
+	return rule{name: defaultRule, action: actionDrop}
+}
+
+// ruleEnv is what expressions are evaluated against
+type ruleEnv struct {
+	detail ObjectDetail
+	prev   objectState
+	known  bool
+}
+
+// kind is the static type of an expression, kindAny is only known when evaluated
+type kind int
+
+const (
+	kindAny kind = iota
+	kindBool
+	kindNumber
+	kindDuration
+	kindString
+)
+
+// expr is a parsed rule expression, evaluating to a bool, float64, time.Duration,
+// string, or nil for missing attributes
+type expr interface {
+	eval(env ruleEnv) interface{}
+	kind() kind
+}
+
+type literal struct {
+	value interface{}
+	k     kind
+}
+
+func (l literal) eval(ruleEnv) interface{} { return l.value }
+func (l literal) kind() kind               { return l.k }
+
+// identifiers are the fields of a detail an expression can read:
+//
+//	id            the object id
+//	online        whether it's online
+//	unknown       whether upstream answered 404 for it
+//	changed       whether online differs from the last stored state, true without one
+//	lastseen_gap  time since the last stored state, unbounded without one
+//	attr.a.b      a value from the upstream payload
+var identifiers = map[string]ident{
+	"id":      {kindNumber, func(env ruleEnv) interface{} { return float64(env.detail.ID) }},
+	"online":  {kindBool, func(env ruleEnv) interface{} { return env.detail.Online }},
+	"unknown": {kindBool, func(env ruleEnv) interface{} { return env.detail.Unknown }},
+	"changed": {kindBool, func(env ruleEnv) interface{} {
+		return !env.known || env.prev.online != env.detail.Online
+	}},
+	"lastseen_gap": {kindDuration, func(env ruleEnv) interface{} {
+		if !env.known {
+			return time.Duration(math.MaxInt64)
+		}
+		return env.detail.LastSeen.Sub(env.prev.lastSeen)
+	}},
+}
+
+type ident struct {
+	k  kind
+	fn func(env ruleEnv) interface{}
+}
+
+func (i ident) eval(env ruleEnv) interface{} { return i.fn(env) }
+func (i ident) kind() kind                   { return i.k }
+
+// attr reads a value at path from the attributes
+type attr []string
+
+func (a attr) kind() kind { return kindAny }
+
+func (a attr) eval(env ruleEnv) interface{} {
+	var value interface{} = env.detail.Attributes
+	for _, segment := range a {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[segment]
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil
+		}
+		return f
+	case float64, bool, string:
+		return v
+	}
+	return nil
+}
+
+type not struct{ x expr }
+
+func (n not) kind() kind { return kindBool }
+
+func (n not) eval(env ruleEnv) interface{} {
+	b, ok := n.x.eval(env).(bool)
+	return ok && !b
+}
+
+type logical struct {
+	op   string
+	x, y expr
+}
+
+func (l logical) kind() kind { return kindBool }
+
+func (l logical) eval(env ruleEnv) interface{} {
+	x, _ := l.x.eval(env).(bool)
+	if l.op == "&&" {
+		if !x {
+			return false
+		}
+	} else if x {
+		return true
+	}
+	y, _ := l.y.eval(env).(bool)
+	return y
+}
+
+type comparison struct {
+	op   string
+	x, y expr
+}
+
+func (c comparison) kind() kind { return kindBool }
+
+// eval compares values of the same type, values of different types are only unequal
+func (c comparison) eval(env ruleEnv) interface{} {
+	x, y := c.x.eval(env), c.y.eval(env)
+
+	var cmp int
+	switch xv := x.(type) {
+	case bool:
+		yv, ok := y.(bool)
+		if !ok || (c.op != "==" && c.op != "!=") {
+			return c.op == "!="
+		}
+		if xv != yv {
+			cmp = 1
+		}
+	case float64:
+		yv, ok := y.(float64)
+		if !ok {
+			return c.op == "!="
+		}
+		cmp = compareFloats(xv, yv)
+	case time.Duration:
+		yv, ok := y.(time.Duration)
+		if !ok {
+			return c.op == "!="
+		}
+		cmp = compareFloats(float64(xv), float64(yv))
+	case string:
+		yv, ok := y.(string)
+		if !ok {
+			return c.op == "!="
+		}
+		cmp = strings.Compare(xv, yv)
+	default:
+		return c.op == "!="
+	}
+
+	switch c.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// parseExpr parses an expression such as online == true || lastseen_gap > 60s, with
+// !, &&, || and comparisons between identifiers and bool, number, duration or "string" literals
+func parseExpr(src string) (expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if k := e.kind(); k != kindBool && k != kindAny {
+		return nil, fmt.Errorf("expression must be a condition")
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) or() (expr, error) {
+	return p.binary("||", p.and)
+}
+
+func (p *exprParser) and() (expr, error) {
+	return p.binary("&&", p.unary)
+}
+
+func (p *exprParser) binary(op string, operand func() (expr, error)) (expr, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == op {
+		p.pos++
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if !condition(x) || !condition(y) {
+			return nil, fmt.Errorf("%s needs conditions on both sides", op)
+		}
+		x = logical{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) unary() (expr, error) {
+	if p.peek() == "!" {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if !condition(x) {
+			return nil, fmt.Errorf("! needs a condition")
+		}
+		return not{x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *exprParser) comparison() (expr, error) {
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		y, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if x.kind() != kindAny && y.kind() != kindAny && x.kind() != y.kind() {
+			return nil, fmt.Errorf("can't compare values of different types with %s", op)
+		}
+		if op != "==" && op != "!=" && (x.kind() == kindBool || y.kind() == kindBool) {
+			return nil, fmt.Errorf("bools can only be compared with == and !=")
+		}
+		return comparison{op: op, x: x, y: y}, nil
+	}
+	return x, nil
+}
+
+func (p *exprParser) operand() (expr, error) {
+	tok := p.peek()
+	p.pos++
+
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case tok == "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	case tok == "true" || tok == "false":
+		return literal{tok == "true", kindBool}, nil
+	case tok[0] == '"':
+		s, err := strconv.Unquote(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", tok)
+		}
+		return literal{s, kindString}, nil
+	case unicode.IsDigit(rune(tok[0])):
+		if f, err := strconv.ParseFloat(tok, 64); err == nil {
+			return literal{f, kindNumber}, nil
+		}
+		d, err := time.ParseDuration(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number or duration %q", tok)
+		}
+		return literal{d, kindDuration}, nil
+	case strings.HasPrefix(tok, "attr."):
+		path := strings.Split(strings.TrimPrefix(tok, "attr."), ".")
+		for _, segment := range path {
+			if segment == "" {
+				return nil, fmt.Errorf("invalid attribute %q", tok)
+			}
+		}
+		return attr(path), nil
+	}
+
+	id, ok := identifiers[tok]
+	if !ok {
+		return nil, fmt.Errorf("unknown identifier %q", tok)
+	}
+	return id, nil
+}
+
+func condition(x expr) bool {
+	return x.kind() == kindBool || x.kind() == kindAny
+}
+
+// tokenize splits src into operators, parentheses, quoted strings and words
+func tokenize(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(src[i:], "&&") || strings.HasPrefix(src[i:], "||") ||
+			strings.HasPrefix(src[i:], "==") || strings.HasPrefix(src[i:], "!=") ||
+			strings.HasPrefix(src[i:], "<=") || strings.HasPrefix(src[i:], ">="):
+			tokens = append(tokens, src[i:i+2])
+			i += 2
+		case c == '<' || c == '>' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, src[i:j+1])
+			i = j + 1
+		case c == '_' || c == '.' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] == '-' ||
+				unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return tokens, nil
+}
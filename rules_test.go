@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnv() ruleEnv {
+	now := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	return ruleEnv{
+		detail: ObjectDetail{
+			ID:       7,
+			Online:   true,
+			LastSeen: now,
+			Attributes: map[string]interface{}{
+				"id":      json.Number("7"),
+				"region":  "eu",
+				"flag":    true,
+				"battery": map[string]interface{}{"level": json.Number("8")},
+			},
+		},
+		prev:  objectState{online: false, lastSeen: now.Add(-90 * time.Second)},
+		known: true,
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	unknown := testEnv()
+	unknown.prev, unknown.known = objectState{}, false
+
+	tests := []struct {
+		src  string
+		env  ruleEnv
+		want bool
+	}{
+		//precedence: ! binds tighter than &&, which binds tighter than ||
+		{"online == true || id == 1 && false", testEnv(), true},
+		{"(online == true || id == 1) && false", testEnv(), false},
+		{"online == false || id == 7 && !unknown", testEnv(), true},
+		{"!unknown && !(id == 7)", testEnv(), false},
+		{"!!online", testEnv(), true},
+
+		{"id >= 7 && id < 8", testEnv(), true},
+		{"id != 7", testEnv(), false},
+		{"changed", testEnv(), true},
+		{"changed", unknown, true},
+
+		//durations
+		{"lastseen_gap > 60s", testEnv(), true},
+		{"lastseen_gap >= 1m30s", testEnv(), true},
+		{"lastseen_gap > 2m", testEnv(), false},
+		{"lastseen_gap > 1000h", unknown, true},
+
+		//attr. paths
+		{"attr.battery.level < 10", testEnv(), true},
+		{"attr.battery.level == 8", testEnv(), true},
+		{`attr.region == "eu"`, testEnv(), true},
+		{`attr.region < "fr"`, testEnv(), true},
+		{"attr.flag", testEnv(), true},
+		{"attr.flag == online", testEnv(), true},
+		{"attr.id == id", testEnv(), true},
+
+		//values of different types are only unequal
+		{"attr.region > 5", testEnv(), false},
+		{"attr.region == 5", testEnv(), false},
+		{"attr.region != 5", testEnv(), true},
+
+		//missing values
+		{"attr.missing == 1", testEnv(), false},
+		{"attr.missing != 1", testEnv(), true},
+		{"attr.missing", testEnv(), false},
+		{"!attr.missing", testEnv(), false},
+		{"attr.battery.level.x < 10", testEnv(), false},
+		{"attr.region.x == 1", testEnv(), false},
+		{"attr.missing || online", testEnv(), true},
+	}
+
+	for _, tt := range tests {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("parseExpr(%q) error: %v", tt.src, err)
+			continue
+		}
+		//non-bool values, such as missing attributes, don't match
+		if got, _ := e.eval(tt.env).(bool); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"", "unexpected end"},
+		{"online ==", "unexpected end"},
+		{"(online", "missing )"},
+		{"online)", `unexpected ")"`},
+		{"online == true extra", `unexpected "extra"`},
+		{`attr.region == "eu`, "unterminated string"},
+		{"online # 1", "unexpected"},
+		{"foo == 1", `unknown identifier "foo"`},
+		{"attr..level < 10", "invalid attribute"},
+		{"lastseen_gap > 5x", "invalid number or duration"},
+
+		//type errors
+		{"id", "must be a condition"},
+		{`"eu"`, "must be a condition"},
+		{`id == "7"`, "different types"},
+		{"lastseen_gap > 60", "different types"},
+		{"online == 1", "different types"},
+		{"online < true", "only be compared with == and !="},
+		{"attr.flag >= true", "only be compared with == and !="},
+		{"online && id", "needs conditions on both sides"},
+		{"id || online", "needs conditions on both sides"},
+		{"!id", "! needs a condition"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseExpr(tt.src)
+		if err == nil {
+			t.Errorf("parseExpr(%q) succeeded, want error containing %q", tt.src, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseExpr(%q) error %q, want it to contain %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	rules, err := compileRules([]ruleConfig{
+		{Name: "offline", When: "online == false", Action: actionDrop},
+		{Name: "low-battery", When: "attr.battery.level < 10", Action: actionRoute, To: sinkLog},
+		{Name: "changed", When: "changed", Action: actionStore},
+		{Name: "stale", When: "lastseen_gap > 1m", Action: actionRoute, To: sinkHistory},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := testEnv()
+	charged := testEnv()
+	charged.detail.Attributes = map[string]interface{}{"battery": map[string]interface{}{"level": json.Number("90")}}
+	unchanged := charged
+	unchanged.prev.online = true
+	fresh := unchanged
+	fresh.prev.lastSeen = fresh.detail.LastSeen.Add(-time.Second)
+	offline := testEnv()
+	offline.detail.Online = false
+
+	tests := []struct {
+		name string
+		env  ruleEnv
+		want rule
+	}{
+		{"first match wins", env, rule{name: "low-battery", action: actionRoute, sink: sinkLog}},
+		{"offline", offline, rule{name: "offline", action: actionDrop}},
+		{"changed", charged, rule{name: "changed", action: actionStore}},
+		{"stale", unchanged, rule{name: "stale", action: actionRoute, sink: sinkHistory}},
+		{"no match", fresh, rule{name: defaultRule, action: actionDrop}},
+	}
+
+	for _, tt := range tests {
+		got := rules.match(tt.env.detail, tt.env.prev, tt.env.known)
+		if got.name != tt.want.name || got.action != tt.want.action || got.sink != tt.want.sink {
+			t.Errorf("%s: matched %s %s %s, want %s %s %s", tt.name,
+				got.name, got.action, got.sink, tt.want.name, tt.want.action, tt.want.sink)
+		}
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []ruleConfig
+		err   string
+	}{
+		{"empty name", []ruleConfig{{When: "online", Action: actionStore}}, "must be unique"},
+		{"default name", []ruleConfig{{Name: defaultRule, When: "online", Action: actionStore}}, "must be unique"},
+		{"duplicate name", []ruleConfig{
+			{Name: "a", When: "online", Action: actionStore},
+			{Name: "a", When: "unknown", Action: actionStore},
+		}, "must be unique"},
+		{"bad expression", []ruleConfig{{Name: "a", When: "online ==", Action: actionStore}}, "rule a: unexpected end"},
+		{"bad action", []ruleConfig{{Name: "a", When: "online", Action: "keep"}}, "action must be"},
+		{"sink without route", []ruleConfig{{Name: "a", When: "online", Action: actionStore, To: sinkLog}}, "only route takes a sink"},
+		{"route without sink", []ruleConfig{{Name: "a", When: "online", Action: actionRoute}}, "route sink must be"},
+		{"unknown sink", []ruleConfig{{Name: "a", When: "online", Action: actionRoute, To: "kafka"}}, "route sink must be"},
+	}
+
+	for _, tt := range tests {
+		_, err := compileRules(tt.rules)
+		if err == nil {
+			t.Errorf("%s: compileRules succeeded, want error containing %q", tt.name, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %q, want it to contain %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	rules, err := compileRules(defaultConfig().Store.Rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		detail ObjectDetail
+		want   string
+	}{
+		{ObjectDetail{ID: 1, Online: true}, actionStore},
+		{ObjectDetail{ID: 1, Unknown: true}, actionStore},
+		{ObjectDetail{ID: 1}, actionDrop},
+	}
+
+	for _, tt := range tests {
+		if got := rules.match(tt.detail, objectState{}, false); got.action != tt.want {
+			t.Errorf("%+v: %s, want %s", tt.detail, got.action, tt.want)
+		}
+	}
+}
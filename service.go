@@ -2,50 +2,233 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/lib/pq"
 )
 
-// toStore stores the details of an object to psql
-func (db *database) toStore(ctx context.Context, detail ObjectDetail) error {
-	query := "insert into objects (id, online, lastseen) values($1, $2, $3)"
+// toStore upserts the latest state of a batch of objects to psql with a single
+// multi-row statement, and copies them to the objects history table when history is enabled
+func (db *database) toStore(ctx context.Context, details []ObjectDetail) error {
+	if len(details) == 0 {
+		return nil
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	//a statement can't upsert the same id twice, so only the newest detail per id is kept
+	latest := make(map[int]int, len(details))
+	for i, detail := range details {
+		if j, ok := latest[detail.ID]; ok && details[j].LastSeen.After(detail.LastSeen) {
+			continue
+		}
+		latest[detail.ID] = i
+	}
 
-	if _, err := db.db.ExecContext(ctx, query, detail.ID, detail.Online, detail.LastSeen); err != nil {
-		return fmt.Errorf("error inserting object details: %v", err)
+	//rows are locked in id order, so concurrent writers upserting overlapping batches can't deadlock
+	ids := make([]int, 0, len(latest))
+	for id := range latest {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	values := make([]string, 0, len(ids))
+	args := make([]interface{}, 0, len(ids)*5)
+	for _, id := range ids {
+		detail := details[latest[id]]
+		attributes, err := detail.attributes()
+		if err != nil {
+			return err
+		}
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d::jsonb)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, detail.ID, detail.Online, detail.LastSeen, detail.Unknown, attributes)
+	}
+
+	//older polls finishing late must not overwrite a newer state
+	query := `insert into object_state (id, online, lastseen, unknown, attributes) values ` + strings.Join(values, ", ") + `
+		on conflict (id) do update set online = excluded.online, lastseen = excluded.lastseen,
+			unknown = excluded.unknown, attributes = excluded.attributes
+		where object_state.lastseen <= excluded.lastseen`
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("error upserting object state: %v", err)
+	}
+
+	if db.history {
+		if err := copyHistory(ctx, tx, details); err != nil {
+			return fmt.Errorf("error copying object history: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing object details: %v", err)
 	}
 	return nil
 }
 
+// attributes returns the attributes of d as a json object
+func (d ObjectDetail) attributes() (string, error) {
+	if d.Attributes == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(d.Attributes)
+	if err != nil {
+		return "", fmt.Errorf("error encoding attributes of object %d: %v", d.ID, err)
+	}
+	return string(b), nil
+}
+
+// copyHistory appends details to the objects table using COPY
+func copyHistory(ctx context.Context, tx *sql.Tx, details []ObjectDetail) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("objects", "id", "online", "lastseen", "unknown", "attributes"))
+	if err != nil {
+		return err
+	}
+
+	for _, detail := range details {
+		attributes, err := detail.attributes()
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, detail.ID, detail.Online, detail.LastSeen, detail.Unknown, attributes); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
 func (db *database) deleteDetail(ctx context.Context) {
-	for range time.NewTicker(time.Second * 5).C {
-		query := "delete from objects where lastseen < now() - interval '30 seconds'"
+	interval := db.purgeEvery()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-		if _, err := db.db.ExecContext(ctx, query); err != nil {
-			db.errChan <- err
+		if next := db.purgeEvery(); next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+		retention := time.Duration(atomic.LoadInt64(&db.retention))
+
+		//the latest states are kept unless they have a retention of their own
+		if stateRetention := time.Duration(atomic.LoadInt64(&db.stateRetention)); stateRetention > 0 {
+			if err := db.purgeStates(ctx, stateRetention); err != nil && ctx.Err() == nil {
+				db.errChan <- err
+			}
+		}
+
+		query := "delete from objects where lastseen < now() - make_interval(secs => $1)"
+		res, err := db.db.ExecContext(ctx, query, retention.Seconds())
+		if err != nil {
+			if ctx.Err() == nil {
+				db.errChan <- err
+			}
 			continue
 		}
+		if n, err := res.RowsAffected(); err == nil {
+			rowsPurged.add(float64(n), "objects")
+		}
+	}
+}
+
+// purgeStates deletes the object states not polled within retention, and drops them from the state trackers
+func (db *database) purgeStates(ctx context.Context, retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+	rows, err := db.db.QueryContext(ctx, "delete from object_state where lastseen < $1 returning id", cutoff)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+
+	rowsPurged.add(float64(len(ids)), "object_state")
+	db.states.forget(ids, cutoff)
+	db.observed.forget(ids, cutoff)
+	return nil
+}
+
+func (db *database) purgeEvery() time.Duration {
+	return time.Duration(atomic.LoadInt64(&db.purgeInterval))
+}
+
+// setRetention changes how often and how far back deleteDetail purges history and object state rows
+func (db *database) setRetention(purgeInterval, retention, stateRetention time.Duration) {
+	atomic.StoreInt64(&db.purgeInterval, int64(purgeInterval))
+	atomic.StoreInt64(&db.retention, int64(retention))
+	atomic.StoreInt64(&db.stateRetention, int64(stateRetention))
+}
+
+// upstream returns the http client and path used for fetching
+func (c *client) upstream() (*http.Client, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cli, c.path
+}
+
+// setUpstream changes the upstream path and request timeout, requests in flight aren't affected
+func (c *client) setUpstream(path string, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cli = &http.Client{Timeout: timeout}
+	c.path = path
 }
 
 // fetchDetail calls localhost:9010/objects/id to receive details of an object by its id
 func (c *client) fetchDetail(ctx context.Context, objectID int) (ObjectDetail, error) {
-	path := c.path + strconv.Itoa(objectID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, nil)
+	cli, base := c.upstream()
+	req, err := http.NewRequestWithContext(ctx, c.method, objectURL(base, objectID), nil)
 	if err != nil {
 		return ObjectDetail{}, err
 	}
+	req.Header.Set("Accept", c.decoder.accept())
 
-	resp, err := c.cli.Do(req)
+	resp, err := c.do(ctx, cli, req)
 	if err != nil {
 		return ObjectDetail{}, err
 	}
 	defer resp.Body.Close()
 
-	detail := ObjectDetail{}
-	if err := json.NewDecoder(resp.Body).Decode(&detail); err != nil {
+	detail, err := c.decodeDetail(resp.Body, objectID)
+	if err != nil {
 		return ObjectDetail{}, err
 	}
 
@@ -53,3 +236,88 @@ func (c *client) fetchDetail(ctx context.Context, objectID int) (ObjectDetail, e
 
 	return detail, nil
 }
+
+// objectURL returns the url of an object, replacing {id} in base or appending the id to it
+func objectURL(base string, objectID int) string {
+	id := strconv.Itoa(objectID)
+	if strings.Contains(base, "{id}") {
+		return strings.ReplaceAll(base, "{id}", id)
+	}
+	return base + id
+}
+
+// do sends req upstream with the configured headers and auth, within the rate and concurrency
+// limits, returning a *statusError for non-2xx responses. Credentials that can go stale are
+// renewed and the request sent once more when upstream answers 401. The caller must close the body of the returned response
+func (c *client) do(ctx context.Context, cli *http.Client, req *http.Request) (*http.Response, error) {
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	if cid := correlationID(ctx); cid != "" {
+		req.Header.Set("X-Correlation-ID", cid)
+	}
+	if c.auth == nil {
+		return c.send(ctx, cli, req)
+	}
+	if err := c.auth.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(ctx, cli, req)
+	stale, ok := c.auth.(invalidator)
+	var status *statusError
+	if !ok || !errors.As(err, &status) || status.code != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return nil, err
+	}
+
+	logFor(ctx).info("upstream rejected credentials, renewing them", "url", req.URL.String())
+	stale.invalidate(req)
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.auth.authorize(ctx, retry); err != nil {
+		return nil, err
+	}
+	return c.send(ctx, cli, retry)
+}
+
+// send sends an authorized req upstream within the rate and concurrency limits
+func (c *client) send(ctx context.Context, cli *http.Client, req *http.Request) (*http.Response, error) {
+	if err := c.rate.wait(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+	if err := c.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := cli.Do(req)
+	rtt := time.Since(start)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.limiter.release(rtt, err)
+		fetchDuration.observe(rtt.Seconds(), "error")
+		logFor(ctx).debug("error fetching", "url", req.URL.String(), "error", err)
+		return nil, err
+	}
+	fetchDuration.observe(rtt.Seconds(), strconv.Itoa(resp.StatusCode))
+	logFor(ctx).debug("fetched", "url", req.URL.String(), "status", resp.StatusCode, "duration", rtt)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := newStatusError(resp)
+		resp.Body.Close()
+		c.limiter.release(rtt, err)
+		return nil, err
+	}
+	c.limiter.release(rtt, nil)
+
+	return resp, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// objectState is the last stored or observed state of an object, and since when it has been in it
+type objectState struct {
+	online   bool
+	lastSeen time.Time
+	since    time.Time
+}
+
+// stateTracker holds the last state of up to size objects, evicting the least recently used one
+// beyond that. One holds the stored states, which filter rules compare details to, and another
+// the observed ones, which transitions are detected from. An evicted object is treated as never seen
+type stateTracker struct {
+	size int
+
+	mu     sync.Mutex
+	order  *list.List
+	states map[int]*list.Element
+}
+
+type trackedState struct {
+	id    int
+	state objectState
+}
+
+func newStateTracker(size int) *stateTracker {
+	return &stateTracker{
+		size:   size,
+		order:  list.New(),
+		states: make(map[int]*list.Element),
+	}
+}
+
+// get returns the last stored state of an object, and whether there's one
+func (t *stateTracker) get(id int) (objectState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lookup(id)
+}
+
+// set records stored details, older ones finishing late don't overwrite newer ones
+func (t *stateTracker) set(details []ObjectDetail) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, detail := range details {
+		if state, ok := t.lookup(detail.ID); ok && state.lastSeen.After(detail.LastSeen) {
+			continue
+		}
+		t.put(detail.ID, objectState{online: detail.Online, lastSeen: detail.LastSeen})
+	}
+}
+
+// forget drops the states of ids last seen before the given time, such as the ones purged from object_state
+func (t *stateTracker) forget(ids []int, before time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, id := range ids {
+		if el, ok := t.states[id]; ok && el.Value.(*trackedState).state.lastSeen.Before(before) {
+			t.order.Remove(el)
+			delete(t.states, id)
+		}
+	}
+}
+
+// lookup returns the state of id and marks it as recently used, t.mu must be held
+func (t *stateTracker) lookup(id int) (objectState, bool) {
+	el, ok := t.states[id]
+	if !ok {
+		return objectState{}, false
+	}
+	t.order.MoveToFront(el)
+	return el.Value.(*trackedState).state, true
+}
+
+// put records the state of id, evicting the least recently used states beyond t.size, t.mu must be held
+func (t *stateTracker) put(id int, state objectState) {
+	if el, ok := t.states[id]; ok {
+		el.Value.(*trackedState).state = state
+		t.order.MoveToFront(el)
+		return
+	}
+
+	t.states[id] = t.order.PushFront(&trackedState{id: id, state: state})
+	for t.order.Len() > t.size {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.states, oldest.Value.(*trackedState).id)
+	}
+}
+
+func (t *stateTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.order.Len()
+}
+
+// loadStates fills the state trackers from object_state, so rules and transitions carry on from
+// the states stored before a restart. An object is in its state since its last transition, or its lastseen without one.
+// Details that aren't stored, such as offline ones with the default rules, can have moved the observed state past the
+// stored one, in which case a transition newer than the stored state tells the observed one.
+// States are loaded oldest first, so the most recent ones are kept when there are more than the trackers hold
+func (db *database) loadStates(ctx context.Context) error {
+	query := `select s.id, s.online, s.lastseen, t.at, t.event from object_state s
+		left join lateral (
+			select at, event from object_transitions where object_id = s.id order by at desc, id desc limit 1
+		) t on true
+		order by s.lastseen`
+
+	rows, err := db.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	db.states.mu.Lock()
+	defer db.states.mu.Unlock()
+	db.observed.mu.Lock()
+	defer db.observed.mu.Unlock()
+
+	for rows.Next() {
+		var (
+			id     int
+			stored objectState
+			at     sql.NullTime
+			event  sql.NullString
+		)
+		if err := rows.Scan(&id, &stored.online, &stored.lastSeen, &at, &event); err != nil {
+			return err
+		}
+		db.states.put(id, stored)
+
+		observed := stored
+		observed.since = stored.lastSeen
+		if at.Valid {
+			observed.since = at.Time
+			if at.Time.After(stored.lastSeen) {
+				observed.online = event.String == eventWentOnline
+				observed.lastSeen = at.Time
+			}
+		}
+		db.observed.put(id, observed)
+	}
+	return rows.Err()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -47,6 +48,28 @@ func main() {
 
 		w.Write([]byte(fmt.Sprintf(`{"id":%d,"online":%v}`, id, id%2 == 0)))
 	})
+	//batch lookup, {"object_ids": [...]} in, a list of details out
+	http.HandleFunc("/objects", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		time.Sleep(time.Duration(rng.Int63n(4000)+300) * time.Millisecond)
+
+		list := struct {
+			ObjectIDs []int `json:"object_ids"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		details := make([]string, len(list.ObjectIDs))
+		for i, id := range list.ObjectIDs {
+			details[i] = fmt.Sprintf(`{"id":%d,"online":%v}`, id, id%2 == 0)
+		}
+		w.Write([]byte("[" + strings.Join(details, ",") + "]"))
+	})
 	go func() { _ = http.ListenAndServe(":9010", nil) }()
 
 	sig := make(chan os.Signal, 1)
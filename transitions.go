@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transition events
+const (
+	eventWentOnline  = "went_online"
+	eventWentOffline = "went_offline"
+)
+
+// transition is an object going online or offline, after being in the other state since Since
+type transition struct {
+	ObjectID      int       `json:"object_id"`
+	Event         string    `json:"event"`
+	At            time.Time `json:"at"`
+	Since         time.Time `json:"since"`
+	DurationMS    int64     `json:"duration_ms"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+}
+
+// observe records a fetched detail as the last known state of its object, and returns the transition
+// it makes from the previous one. Objects seen for the first time, unknown ones and details older
+// than the known state make none
+func (t *stateTracker) observe(detail ObjectDetail) (transition, bool) {
+	if detail.Unknown {
+		return transition{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev, known := t.lookup(detail.ID)
+	if known && prev.lastSeen.After(detail.LastSeen) {
+		return transition{}, false
+	}
+
+	next := objectState{online: detail.Online, lastSeen: detail.LastSeen, since: detail.LastSeen}
+	if known && prev.online == detail.Online {
+		next.since = prev.since
+	}
+	t.put(detail.ID, next)
+
+	if !known || prev.online == detail.Online {
+		return transition{}, false
+	}
+
+	event := eventWentOffline
+	if detail.Online {
+		event = eventWentOnline
+	}
+	return transition{
+		ObjectID:   detail.ID,
+		Event:      event,
+		At:         detail.LastSeen,
+		Since:      prev.since,
+		DurationMS: detail.LastSeen.Sub(prev.since).Milliseconds(),
+	}, true
+}
+
+// saveTransitions inserts transitions with a single multi-row statement
+func (db *database) saveTransitions(ctx context.Context, transitions []transition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(transitions))
+	args := make([]interface{}, 0, len(transitions)*6)
+	for _, t := range transitions {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6))
+		args = append(args, t.ObjectID, t.Event, t.At, t.Since, t.DurationMS, t.CorrelationID)
+	}
+
+	query := `insert into object_transitions (object_id, event, at, since, duration_ms, correlation_id) values ` +
+		strings.Join(values, ", ")
+	if _, err := db.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("error saving object transitions: %v", err)
+	}
+	return nil
+}
+
+// listTransitions returns up to limit transitions of an object, newest first
+func (db *database) listTransitions(ctx context.Context, objectID int, limit int) ([]transition, error) {
+	query := `select object_id, event, at, since, duration_ms, correlation_id from object_transitions
+		where object_id = $1 order by at desc, id desc limit $2`
+
+	rows, err := db.db.QueryContext(ctx, query, objectID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := make([]transition, 0)
+	for rows.Next() {
+		t := transition{}
+		if err := rows.Scan(&t.ObjectID, &t.Event, &t.At, &t.Since, &t.DurationMS, &t.CorrelationID); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+// handleTransitions serves GET /objects/{id}/transitions?limit=N
+func (db *database) handleTransitions(w http.ResponseWriter, r *http.Request, objectID int) {
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transitions, err := db.listTransitions(r.Context(), objectID, limit)
+	if err != nil {
+		logFor(r.Context()).error("error listing transitions", "object_id", objectID, "error", err)
+		http.Error(w, "error listing transitions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Transitions []transition `json:"transitions"`
+	}{transitions})
+}
+
+// parseObjectPath splits /objects/{id} and /objects/{id}/transitions
+func parseObjectPath(path string) (int, string, error) {
+	rest := strings.TrimPrefix(path, "/objects/")
+	sub := ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest, sub = rest[:i], rest[i+1:]
+	}
+	//ids are psql integers
+	id, err := strconv.ParseInt(rest, 10, 32)
+	return int(id), sub, err
+}